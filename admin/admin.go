@@ -0,0 +1,93 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"log/slog"
+	"my-api/config"
+	"my-api/logging"
+	"my-api/utils"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type setupCodes struct {
+	mu    sync.Mutex
+	codes map[string]time.Time // code -> expiry
+}
+
+var (
+	user, password string
+	codes          = setupCodes{codes: map[string]time.Time{}}
+)
+
+// InitAdmin sets the admin login. Without a password admin routes only accept one-time setup codes.
+func InitAdmin(cfg config.Admin) error {
+	user, password = cfg.User, cfg.Password
+
+	if password == "" {
+		slog.Warn("ADMIN_PASSWORD is not set, admin routes only accept one-time setup codes")
+	}
+
+	return nil
+}
+
+// NewSetupCode returns a code that grants access to one admin request until ttl passes
+func NewSetupCode(ttl time.Duration) string {
+	code := utils.GetRandomState()
+
+	codes.mu.Lock()
+	defer codes.mu.Unlock()
+
+	now := time.Now()
+	for c, expiry := range codes.codes {
+		if now.After(expiry) {
+			delete(codes.codes, c)
+		}
+	}
+	codes.codes[code] = now.Add(ttl)
+
+	return code
+}
+
+func useSetupCode(code string) bool {
+	if code == "" {
+		return false
+	}
+
+	codes.mu.Lock()
+	defer codes.mu.Unlock()
+
+	expiry, ok := codes.codes[code]
+	delete(codes.codes, code)
+	return ok && time.Now().Before(expiry)
+}
+
+// Authorized reports whether the request carries the admin credentials (basic auth)
+func Authorized(ctx *gin.Context) bool {
+	if password == "" {
+		return false
+	}
+
+	reqUser, reqPassword, ok := ctx.Request.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(reqUser), []byte(user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(reqPassword), []byte(password)) == 1
+}
+
+// Required only lets through requests with admin basic auth or a valid ?setup_code=
+func Required() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if Authorized(ctx) || useSetupCode(ctx.Query("setup_code")) {
+			ctx.Next()
+			return
+		}
+
+		logging.From(ctx).Warn("Rejected admin request", slog.String("path", ctx.Request.URL.Path), slog.String("ip", ctx.ClientIP()))
+		if password != "" {
+			ctx.Header("WWW-Authenticate", `Basic realm="mangopost admin"`)
+		}
+		ctx.AbortWithStatusJSON(401, gin.H{"error": "Unauthorized"})
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"my-api/config"
+	"my-api/gmail"
+	"my-api/logging"
+	"my-api/slack"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// runClassifyReport prints what the classifier would label in the inbox, without changing anything.
+// Usage: ./api classify-report [-account default] [-since 168h] [-all]
+func runClassifyReport(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("classify-report", flag.ContinueOnError)
+	accountName := flags.String("account", "", "gmail account, optional when only one is configured")
+	since := flags.Duration("since", 7*24*time.Hour, "how far back to look in the inbox")
+	all := flags.Bool("all", false, "also list threads that would stay unlabelled")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	account, err := initGmailCommand(cfg, *accountName)
+	if err != nil {
+		return err
+	}
+	if !gmail.ClassifierEnabled() {
+		return fmt.Errorf("G_CLASSIFIER isn't set")
+	}
+
+	report, err := gmail.ClassifyReport(ctx, account, *since)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "THREAD\tFROM\tSUBJECT\tLABEL\tSOURCE\tSCORE")
+	labelled := 0
+	for _, result := range report {
+		if result.Label != "" {
+			labelled++
+		} else if !*all {
+			continue
+		}
+
+		score := ""
+		if result.Score > 0 {
+			score = fmt.Sprintf("%.2f", result.Score)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			result.ThreadID, result.From, truncate(result.Subject, 50), result.Label, result.Source, score)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("\n%d of %d threads would be labelled\n", labelled, len(report))
+	return nil
+}
+
+// runTrainClassifier trains the naive Bayes model on mail that is already labelled.
+// Usage: ./api train-classifier [-account default] -labels "Mangopost/FoodSpot Requests" [-limit 500] [-out <STATE_DIR>/classifier.json]
+func runTrainClassifier(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("train-classifier", flag.ContinueOnError)
+	accountName := flags.String("account", "", "gmail account, optional when only one is configured")
+	labels := flags.String("labels", "", "comma separated labels to learn")
+	limit := flags.Int("limit", 500, "maximum threads per label, 0 for all")
+	out := flags.String("out", filepath.Join(cfg.StateDir, "classifier.json"), "model file to write")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *labels == "" {
+		return fmt.Errorf("-labels is required")
+	}
+
+	account, err := initGmailCommand(cfg, *accountName)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, label := range strings.Split(*labels, ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			names = append(names, label)
+		}
+	}
+
+	model, err := gmail.TrainBayes(ctx, account, names, *limit)
+	if err != nil {
+		return err
+	}
+	if err := model.Save(*out); err != nil {
+		return err
+	}
+
+	logging.From(ctx).Info("Trained classifier model", slog.String("out", *out), slog.Int("vocabulary", model.Vocab))
+	return nil
+}
+
+func initGmailCommand(cfg *config.Config, accountName string) (*gmail.Account, error) {
+	if err := slack.InitChannels(cfg.Slack); err != nil {
+		return nil, fmt.Errorf("failed to init slack channels: %w", err)
+	}
+	if err := gmail.InitConfig(cfg.Gmail); err != nil {
+		return nil, fmt.Errorf("failed to init gmail config: %w", err)
+	}
+
+	return gmail.AccountByName(accountName)
+}
+
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}
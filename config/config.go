@@ -0,0 +1,381 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything the app reads at startup. Values come from the YAML file in CONFIG_FILE
+// if set, overridden by the environment variable in each field's env tag. Every env variable
+// can also be given as <NAME>_FILE pointing to a file with the value, e.g. a Docker secret.
+type Config struct {
+	Mode           string   `yaml:"mode" env:"GIN_MODE"` // "dev" or "release"
+	MainURL        string   `yaml:"main_url" env:"MAIN_URL"`
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES"`
+	StateDir       string   `yaml:"state_dir" env:"STATE_DIR"`
+	MetricsToken   string   `yaml:"metrics_token" env:"METRICS_TOKEN"` // bearer token for /metrics, required in release mode
+
+	Admin    Admin    `yaml:"admin"`
+	Slack    Slack    `yaml:"slack"`
+	Gmail    Gmail    `yaml:"gmail"`
+	Webhooks Webhooks `yaml:"webhooks"`
+}
+
+type Admin struct {
+	User     string `yaml:"user" env:"ADMIN_USER"`
+	Password string `yaml:"password" env:"ADMIN_PASSWORD"` // optional, admin routes then only take setup codes
+}
+
+// Slack holds the webhook URL of each channel. The channel IDs are only needed with a bot token.
+type Slack struct {
+	InternalNotifications   string `yaml:"internal_notifications" env:"SLACK_INTERNAL_NOTIFICATIONS"`
+	InternalNotificationsID string `yaml:"internal_notifications_id" env:"SLACK_INTERNAL_NOTIFICATIONS_ID"`
+	OrderHistory            string `yaml:"order_history" env:"SLACK_ORDER_HISTORY"`
+	OrderHistoryID          string `yaml:"order_history_id" env:"SLACK_ORDER_HISTORY_ID"`
+	ScriptErrors            string `yaml:"script_errors" env:"SLACK_SCRIPT_ERRORS"`
+	ScriptErrorsID          string `yaml:"script_errors_id" env:"SLACK_SCRIPT_ERRORS_ID"`
+	BotToken                string `yaml:"bot_token" env:"SLACK_BOT_TOKEN"`
+}
+
+type Webhooks struct {
+	WCSecret     string `yaml:"wc_secret" env:"WC_SECRET"`
+	WCOrderURL   string `yaml:"wc_order_url" env:"WC_ORDER_URL"` // admin order page, the order ID is appended as &id=
+	DigestRoutes string `yaml:"digest_routes" env:"SLACK_DIGEST_ROUTES"`
+
+	// OrderConfirmationFrom is the Gmail account that emails customers an order confirmation, off if empty
+	OrderConfirmationFrom string `yaml:"order_confirmation_from" env:"WC_ORDER_CONFIRMATION_FROM"`
+
+	Digests []DigestRoute `yaml:"-"` // parsed DigestRoutes
+}
+
+// DigestRoute batches one webhook route, see Webhooks.DigestRoutes
+type DigestRoute struct {
+	From, Event string
+	Window      time.Duration
+	MaxItems    int
+}
+
+type Gmail struct {
+	MainURL  string `yaml:"-"` // copied from Config
+	StateDir string `yaml:"-"`
+
+	ClientID string `yaml:"client_id" env:"G_CLIENT_ID"`
+	Secret   string `yaml:"secret" env:"G_SECRET"`
+
+	// either one mailbox configured here, or a JSON file with a list of accounts
+	Mail                 string   `yaml:"mail" env:"G_MAIL"`
+	Accounts             string   `yaml:"accounts" env:"G_ACCOUNTS"`
+	AuthMode             string   `yaml:"auth_mode" env:"G_AUTH_MODE"`
+	ServiceAccountKey    string   `yaml:"service_account_key" env:"G_SERVICE_ACCOUNT_KEY"`
+	ServiceAccountScopes []string `yaml:"service_account_scopes" env:"G_SERVICE_ACCOUNT_SCOPES"`
+	FakeSeed             string   `yaml:"fake_seed" env:"G_FAKE_SEED"`
+	LabelWatches         string   `yaml:"label_watches" env:"G_LABEL_WATCHES"`
+
+	ExtractRules string `yaml:"extract_rules" env:"G_EXTRACT_RULES"`
+	Classifier   string `yaml:"classifier" env:"G_CLASSIFIER"`
+	Templates    string `yaml:"templates" env:"G_MAIL_TEMPLATES"`
+
+	PubSubTopic        string `yaml:"pubsub_topic" env:"G_PUBSUB_TOPIC"`
+	PushAudience       string `yaml:"push_audience" env:"G_PUSH_AUDIENCE"`
+	PushServiceAccount string `yaml:"push_service_account" env:"G_PUSH_SERVICE_ACCOUNT"`
+	PushToken          string `yaml:"push_token" env:"G_PUSH_TOKEN"`
+
+	TokenStore TokenStore `yaml:"token_store"`
+}
+
+type TokenStore struct {
+	Kind string `yaml:"kind" env:"TOKEN_STORE"` // "file" (default), "encrypted" or "sqlite"
+	Path string `yaml:"path" env:"TOKEN_PATH"`
+	Key  string `yaml:"key" env:"TOKEN_KEY"` // base64 AES-256 key for "encrypted"
+}
+
+// Load reads and validates the configuration. In dev mode .env.mangopost is loaded first.
+// All problems are returned together, joined into one error.
+func Load() (*Config, error) {
+	cfg := &Config{
+		Mode:     "dev",
+		StateDir: "data",
+		Admin:    Admin{User: "admin"},
+	}
+
+	// the YAML may set the mode, so it's read before deciding whether .env.mangopost is needed
+	path := os.Getenv("CONFIG_FILE")
+	if err := readConfigFile(cfg, path); err != nil {
+		return nil, err
+	}
+
+	mode := os.Getenv("GIN_MODE")
+	if mode == "" {
+		mode = cfg.Mode
+	}
+	if mode == "" || mode == "dev" {
+		if err := godotenv.Load("./.env.mangopost"); err != nil {
+			return nil, fmt.Errorf("failed to load .env.mangopost variables: %w", err)
+		}
+		if path == "" {
+			if err := readConfigFile(cfg, os.Getenv("CONFIG_FILE")); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var problems []error
+	applyEnv(reflect.ValueOf(cfg).Elem(), &problems)
+
+	cfg.Gmail.MainURL = cfg.MainURL
+	cfg.Gmail.StateDir = cfg.StateDir
+	if cfg.Gmail.PushAudience == "" && cfg.MainURL != "" {
+		cfg.Gmail.PushAudience = cfg.MainURL + "/gmail/push"
+	}
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n%w", errors.Join(problems...))
+	}
+
+	return cfg, nil
+}
+
+func readConfigFile(cfg *Config, path string) error {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+	}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return fmt.Errorf("failed to parse CONFIG_FILE %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides the fields that have an env tag with the variable or its _FILE variant
+func applyEnv(v reflect.Value, problems *[]error) {
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+
+		name := field.Tag.Get("env")
+		if name == "" {
+			if field.Type.Kind() == reflect.Struct {
+				applyEnv(value, problems)
+			}
+			continue
+		}
+
+		raw, ok, err := lookup(name)
+		if err != nil {
+			*problems = append(*problems, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		switch value.Kind() {
+		case reflect.String:
+			value.SetString(raw)
+		case reflect.Slice:
+			value.Set(reflect.ValueOf(splitList(raw)))
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(raw)
+			if err != nil {
+				*problems = append(*problems, fmt.Errorf("%s: expected true or false, got %q", name, raw))
+				continue
+			}
+			value.SetBool(parsed)
+		}
+	}
+}
+
+func lookup(name string) (string, bool, error) {
+	if value := os.Getenv(name); value != "" {
+		return value, true, nil
+	}
+
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return "", false, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+// splitList accepts comma or whitespace separated values
+func splitList(raw string) []string {
+	return strings.FieldsFunc(raw, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+func (c *Config) validate() []error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	if c.Mode != "dev" && c.Mode != "release" {
+		problem("GIN_MODE: expected dev or release, got %q", c.Mode)
+	}
+
+	checkURL := func(name, value string, required bool) {
+		if value == "" {
+			if required {
+				problem("%s is required", name)
+			}
+			return
+		}
+		parsed, err := url.Parse(value)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			problem("%s: %q is not an http(s) URL", name, value)
+		}
+	}
+
+	checkFile := func(name, path string) {
+		if path == "" {
+			return
+		}
+		if _, err := os.Stat(path); err != nil {
+			problem("%s: %v", name, err)
+		}
+	}
+
+	checkURL("MAIN_URL", c.MainURL, true)
+
+	if c.Mode == "release" && len(c.TrustedProxies) == 0 {
+		problem("TRUSTED_PROXIES is required in release mode")
+	}
+	if c.Mode == "release" && c.MetricsToken == "" {
+		problem("METRICS_TOKEN is required in release mode")
+	}
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				problem("TRUSTED_PROXIES: %q is neither an IP nor a CIDR range", proxy)
+			}
+		}
+	}
+
+	checkURL("SLACK_INTERNAL_NOTIFICATIONS", c.Slack.InternalNotifications, true)
+	checkURL("SLACK_ORDER_HISTORY", c.Slack.OrderHistory, true)
+	checkURL("SLACK_SCRIPT_ERRORS", c.Slack.ScriptErrors, true)
+
+	if c.Webhooks.WCSecret == "" {
+		problem("WC_SECRET is required")
+	}
+	checkURL("WC_ORDER_URL", c.Webhooks.WCOrderURL, false)
+
+	digests, err := parseDigestRoutes(c.Webhooks.DigestRoutes)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	c.Webhooks.Digests = digests
+
+	g := c.Gmail
+	if g.Mail == "" && g.Accounts == "" {
+		problem("G_MAIL or G_ACCOUNTS is required")
+	}
+	checkFile("G_ACCOUNTS", g.Accounts)
+	checkFile("G_LABEL_WATCHES", g.LabelWatches)
+	checkFile("G_EXTRACT_RULES", g.ExtractRules)
+	checkFile("G_CLASSIFIER", g.Classifier)
+	checkFile("G_MAIL_TEMPLATES", g.Templates)
+
+	if g.Accounts == "" {
+		switch g.AuthMode {
+		case "", "oauth":
+			if g.ClientID == "" || g.Secret == "" {
+				problem("G_CLIENT_ID and G_SECRET are required for OAuth")
+			}
+		case "service_account":
+			if g.ServiceAccountKey == "" {
+				problem("G_SERVICE_ACCOUNT_KEY is required for G_AUTH_MODE=service_account")
+			}
+			checkFile("G_SERVICE_ACCOUNT_KEY", g.ServiceAccountKey)
+		case "fake":
+			checkFile("G_FAKE_SEED", g.FakeSeed)
+		default:
+			problem("G_AUTH_MODE: expected oauth, service_account or fake, got %q", g.AuthMode)
+		}
+	}
+
+	if g.PubSubTopic != "" {
+		if g.PushServiceAccount == "" && g.PushToken == "" {
+			problem("G_PUBSUB_TOPIC requires G_PUSH_SERVICE_ACCOUNT or G_PUSH_TOKEN")
+		}
+		checkURL("G_PUSH_AUDIENCE", g.PushAudience, false)
+	}
+
+	switch g.TokenStore.Kind {
+	case "", "file", "sqlite":
+	case "encrypted":
+		key, err := base64.StdEncoding.DecodeString(g.TokenStore.Key)
+		if err != nil || len(key) != 32 {
+			problem("TOKEN_KEY: the encrypted token store needs a base64 encoded 32 byte key")
+		}
+	default:
+		problem("TOKEN_STORE: expected file, encrypted or sqlite, got %q", g.TokenStore.Kind)
+	}
+
+	return problems
+}
+
+// parseDigestRoutes reads "from:event=window/maxItems" entries separated by commas,
+// e.g. "wc:order_created=10m/20,timelines:new_message=5m/15"
+func parseDigestRoutes(spec string) ([]DigestRoute, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" {
+		return nil, nil
+	}
+
+	var routes []DigestRoute
+	var problems []error
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		key, value, ok := strings.Cut(entry, "=")
+		from, event, hasEvent := strings.Cut(key, ":")
+		if !ok || !hasEvent || from == "" || event == "" {
+			problems = append(problems, fmt.Errorf("SLACK_DIGEST_ROUTES: invalid entry %q, expected from:event=window/maxItems", entry))
+			continue
+		}
+
+		windowValue, maxValue, _ := strings.Cut(value, "/")
+		window, err := time.ParseDuration(windowValue)
+		if err != nil || window <= 0 {
+			problems = append(problems, fmt.Errorf("SLACK_DIGEST_ROUTES: entry %q has a bad window %q", entry, windowValue))
+			continue
+		}
+
+		maxItems := 0
+		if maxValue != "" {
+			if maxItems, err = strconv.Atoi(maxValue); err != nil || maxItems < 1 {
+				problems = append(problems, fmt.Errorf("SLACK_DIGEST_ROUTES: entry %q has bad max items %q", entry, maxValue))
+				continue
+			}
+		}
+
+		if slices.ContainsFunc(routes, func(r DigestRoute) bool { return r.From == from && r.Event == event }) {
+			problems = append(problems, fmt.Errorf("SLACK_DIGEST_ROUTES: route %q is listed twice", key))
+			continue
+		}
+		routes = append(routes, DigestRoute{From: from, Event: event, Window: window, MaxItems: maxItems})
+	}
+
+	return routes, errors.Join(problems...)
+}
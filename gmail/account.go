@@ -0,0 +1,237 @@
+package gmail
+
+import (
+	"encoding/json"
+	"fmt"
+	"my-api/config"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/jwt"
+	"google.golang.org/api/gmail/v1"
+)
+
+// DefaultAccount is the name of the account built from G_MAIL when G_ACCOUNTS isn't set
+const DefaultAccount = "default"
+
+// Account is one Gmail mailbox with its own token, label watches and sync cursors
+type Account struct {
+	Name              string       `json:"name"` // used in ?account= and job names
+	Email             string       `json:"email"`
+	PermalinkUser     string       `json:"permalink_user,omitempty"`      // the <x> in mail.google.com/mail/u/<x>/, defaults to Email
+	Auth              string       `json:"auth,omitempty"`                // AuthOAuth (default), AuthServiceAccount or AuthFake
+	ServiceAccountKey string       `json:"service_account_key,omitempty"` // key file for AuthServiceAccount
+	FakeSeed          string       `json:"fake_seed,omitempty"`           // seed file for AuthFake, see FakeSeed
+	Scopes            []string     `json:"scopes,omitempty"`              // extra scopes delegated to a service account, e.g. "send"
+	TokenPath         string       `json:"token_path,omitempty"`          // overrides the file of "file" and "encrypted" token stores
+	Watches           []LabelWatch `json:"watches"`
+
+	tokens     TokenStore  // only for AuthOAuth
+	delegation *jwt.Config // only for service accounts
+	fake       *FakeMailbox
+	source     *persistingTokenSource
+
+	scopesMu sync.Mutex
+	granted  []string // scopes of the last OAuth consent
+
+	serviceOnce sync.Once
+	service     *gmail.Service
+	serviceErr  error
+
+	watchMu         sync.Mutex
+	watchExpiration time.Time
+
+	healthMu  sync.Mutex
+	health    TokenHealth
+	alertedAt time.Time
+}
+
+var accounts []*Account
+
+// initAccounts loads G_ACCOUNTS (a JSON file with a list of accounts) or falls back to a
+// single account for G_MAIL watching G_LABEL_WATCHES, authenticated as G_AUTH_MODE
+// with G_SERVICE_ACCOUNT_KEY and G_SERVICE_ACCOUNT_SCOPES for service accounts or G_FAKE_SEED for a fake mailbox
+func initAccounts(cfg config.Gmail) error {
+	var loaded []*Account
+
+	if path := cfg.Accounts; path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read G_ACCOUNTS file: %w", err)
+		}
+		if err := json.Unmarshal(data, &loaded); err != nil {
+			return fmt.Errorf("failed to parse G_ACCOUNTS file: %w", err)
+		}
+		if len(loaded) == 0 {
+			return fmt.Errorf("G_ACCOUNTS file has no accounts")
+		}
+	} else {
+		if cfg.Mail == "" {
+			return fmt.Errorf("failed to initialize Gmail accounts: missing G_MAIL or G_ACCOUNTS value")
+		}
+
+		watches, err := loadLabelWatches(cfg.LabelWatches)
+		if err != nil {
+			return err
+		}
+		loaded = []*Account{{
+			Name:              DefaultAccount,
+			Email:             cfg.Mail,
+			Auth:              cfg.AuthMode,
+			ServiceAccountKey: cfg.ServiceAccountKey,
+			FakeSeed:          cfg.FakeSeed,
+			Scopes:            cfg.ServiceAccountScopes,
+			Watches:           watches,
+		}}
+	}
+
+	names, emails := map[string]bool{}, map[string]bool{}
+	for i, account := range loaded {
+		if account.Name == "" || account.Email == "" {
+			return fmt.Errorf("gmail account #%d: name and email are required", i+1)
+		}
+		if names[account.Name] || emails[strings.ToLower(account.Email)] {
+			return fmt.Errorf("gmail account #%d: duplicate name or email", i+1)
+		}
+		names[account.Name], emails[strings.ToLower(account.Email)] = true, true
+
+		if account.PermalinkUser == "" {
+			account.PermalinkUser = account.Email
+		}
+
+		if err := validateLabelWatches(account.Watches); err != nil {
+			return fmt.Errorf("gmail account %q: %w", account.Name, err)
+		}
+
+		switch account.Auth {
+		case "", AuthOAuth:
+			account.Auth = AuthOAuth
+			var err error
+			if account.tokens, err = NewTokenStore(tokenStoreConfig(cfg.TokenStore, account, cfg.StateDir)); err != nil {
+				return fmt.Errorf("failed to initialize token store for %q: %w", account.Name, err)
+			}
+			if err := account.loadGrantedScopes(); err != nil {
+				return fmt.Errorf("gmail account %q: failed to load granted scopes: %w", account.Name, err)
+			}
+		case AuthServiceAccount:
+			if err := initServiceAccount(account); err != nil {
+				return err
+			}
+		case AuthFake:
+			if err := initFakeMailbox(account, cfg.StateDir); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("gmail account %q: unknown auth mode %q", account.Name, account.Auth)
+		}
+		account.source = &persistingTokenSource{account: account}
+	}
+
+	accounts = loaded
+	return nil
+}
+
+// Accounts returns the configured Gmail accounts
+func Accounts() []*Account {
+	return accounts
+}
+
+// AccountByName returns the named account. An empty name picks the only account if there is just one.
+func AccountByName(name string) (*Account, error) {
+	if name == "" && len(accounts) == 1 {
+		return accounts[0], nil
+	}
+
+	for _, account := range accounts {
+		if account.Name == name {
+			return account, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown gmail account %q", name)
+}
+
+func usesOAuth() bool {
+	for _, account := range accounts {
+		if account.Auth == AuthOAuth {
+			return true
+		}
+	}
+	return false
+}
+
+func accountByEmail(email string) *Account {
+	for _, account := range accounts {
+		if strings.EqualFold(account.Email, email) {
+			return account
+		}
+	}
+	return nil
+}
+
+// WatchByName returns the account's label watch with the given name
+func (a *Account) WatchByName(name string) (LabelWatch, error) {
+	for _, watch := range a.Watches {
+		if watch.Name == name {
+			return watch, nil
+		}
+	}
+	return LabelWatch{}, fmt.Errorf("gmail account %q has no label watch %q", a.Name, name)
+}
+
+func (a *Account) watchedLabels() []string {
+	var labels []string
+	seen := map[string]bool{}
+	for _, watch := range a.Watches {
+		if !seen[watch.Label] {
+			seen[watch.Label] = true
+			labels = append(labels, watch.Label)
+		}
+	}
+	return labels
+}
+
+func (a *Account) permalink(labelName string) string {
+	return fmt.Sprintf("https://mail.google.com/mail/u/%s/#label/%s",
+		url.PathEscape(a.PermalinkUser), url.PathEscape(labelName))
+}
+
+// validateLabelWatches checks the watches of one account
+func validateLabelWatches(watches []LabelWatch) error {
+	names := map[string]bool{}
+	for i, watch := range watches {
+		if watch.Name == "" || watch.Label == "" || watch.Schedule == "" || watch.Channel == "" {
+			return fmt.Errorf("label watch #%d: name, label, schedule and channel are required", i+1)
+		}
+		if names[watch.Name] {
+			return fmt.Errorf("label watch #%d: duplicate name %q", i+1, watch.Name)
+		}
+		if watch.Name == classifierWatch {
+			return fmt.Errorf("label watch #%d: the name %q is reserved for the classifier's cursor", i+1, watch.Name)
+		}
+		names[watch.Name] = true
+
+		if _, err := scheduleParser.Parse(watch.Schedule); err != nil {
+			return fmt.Errorf("label watch %q: invalid schedule %q: %w", watch.Name, watch.Schedule, err)
+		}
+		if _, err := watch.slackChannel(); err != nil {
+			return fmt.Errorf("label watch %q: %w", watch.Name, err)
+		}
+		for _, template := range []string{watch.Draft, watch.Acknowledge} {
+			if template == "" {
+				continue
+			}
+			if err := checkReplyTemplate(template, ExtractorFor(watch.Label)); err != nil {
+				return fmt.Errorf("label watch %q: %w", watch.Name, err)
+			}
+		}
+		if watch.Title == "" {
+			watches[i].Title = fmt.Sprintf("New threads in %s", watch.Label)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"my-api/logging"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// ThreadActions change a thread in Gmail once it has been reported to Slack, so the mailbox
+// shows what has been handled. They need the "modify" scope (see OAuthHandler).
+type ThreadActions struct {
+	AddLabels    []string `json:"add_labels,omitempty"` // created if missing, e.g. "Posted to Slack"
+	RemoveLabels []string `json:"remove_labels,omitempty"`
+	MarkRead     bool     `json:"mark_read,omitempty"`
+	Archive      bool     `json:"archive,omitempty"`
+}
+
+func (a ThreadActions) empty() bool {
+	return len(a.AddLabels) == 0 && len(a.RemoveLabels) == 0 && !a.MarkRead && !a.Archive
+}
+
+// modifyRequest resolves the label names to IDs, creating missing labels that should be added
+func (a ThreadActions) modifyRequest(ctx context.Context, client MailClient) (*gmail.ModifyThreadRequest, error) {
+	labels, err := client.ListLabels(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gmail labels: %w", err)
+	}
+
+	ids := make(map[string]string, len(labels))
+	for _, label := range labels {
+		ids[label.Name] = label.Id
+	}
+
+	req := &gmail.ModifyThreadRequest{}
+	for _, name := range a.AddLabels {
+		id, ok := ids[name]
+		if !ok {
+			created, err := client.CreateLabel(ctx, &gmail.Label{
+				Name:                  name,
+				LabelListVisibility:   "labelShow",
+				MessageListVisibility: "show",
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to create gmail label %q: %w", name, err)
+			}
+			logging.From(ctx).Info("Created Gmail label", slog.String("label", name))
+			id = created.Id
+		}
+		req.AddLabelIds = append(req.AddLabelIds, id)
+	}
+
+	for _, name := range a.RemoveLabels {
+		if id, ok := ids[name]; ok { // a missing label is on no thread
+			req.RemoveLabelIds = append(req.RemoveLabelIds, id)
+		}
+	}
+	if a.MarkRead {
+		req.RemoveLabelIds = append(req.RemoveLabelIds, "UNREAD")
+	}
+	if a.Archive {
+		req.RemoveLabelIds = append(req.RemoveLabelIds, "INBOX")
+	}
+
+	return req, nil
+}
+
+// applyThreadActions runs the watch's actions on the reported threads. The threads are already
+// in Slack, so a failed thread doesn't stop the others.
+func applyThreadActions(ctx context.Context, client MailClient, account *Account, watch LabelWatch, threadIDs []string) error {
+	if watch.Actions.empty() || len(threadIDs) == 0 {
+		return nil
+	}
+	if err := account.requireScope(gmail.GmailModifyScope); err != nil {
+		return err
+	}
+
+	req, err := watch.Actions.modifyRequest(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, id := range threadIDs {
+		if err := client.ModifyThread(ctx, id, req); err != nil {
+			logging.From(ctx).Error("Failed to apply actions to Gmail thread",
+				slog.String("watch", watch.Name), slog.String("thread", id), slog.Any("error", err))
+			failed = append(failed, id)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to apply actions of %q to %d of %d threads", watch.Name, len(failed), len(threadIDs))
+	}
+	return nil
+}
+
+// warnMissingScopes points out at startup what will fail until consent is given
+func warnMissingScopes(account *Account) {
+	if classifier != nil && !classifier.DryRun {
+		if err := account.requireScope(gmail.GmailModifyScope); err != nil {
+			slog.Warn("Classifier can't label mail", slog.Any("error", err))
+		}
+	}
+
+	for _, watch := range account.Watches {
+		if !watch.Actions.empty() {
+			if err := account.requireScope(gmail.GmailModifyScope); err != nil {
+				slog.Warn("Label watch actions won't run", slog.String("watch", watch.Name), slog.Any("error", err))
+			}
+		}
+		if watch.Draft != "" {
+			if err := account.requireScope(gmail.GmailComposeScope, gmail.GmailModifyScope); err != nil {
+				slog.Warn("Label watch can't draft replies", slog.String("watch", watch.Name), slog.Any("error", err))
+			}
+		}
+		if watch.Acknowledge != "" {
+			if err := account.requireScope(gmail.GmailSendScope); err != nil {
+				slog.Warn("Label watch can't acknowledge requests", slog.String("watch", watch.Name), slog.Any("error", err))
+			}
+		}
+	}
+}
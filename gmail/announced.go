@@ -0,0 +1,86 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"my-api/state"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Announcement remembers a thread that was posted to Slack, so it isn't announced again
+// when the label query returns it a second time, and so replies can be told apart
+type Announcement struct {
+	Subject       string    `json:"subject"`
+	LastMessageID string    `json:"last_message_id"` // last message from someone other than the mailbox
+	SlackTS       string    `json:"slack_ts,omitempty"`
+	AnnouncedAt   time.Time `json:"announced_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// announcedState holds the announced threads of one account, keyed by label watch name and thread ID
+type announcedState struct {
+	Watches map[string]map[string]Announcement `json:"watches"`
+}
+
+// forget threads without activity for this long to keep the state small
+const announcementTTL = 180 * 24 * time.Hour
+
+func announcedKey(account *Account) string {
+	return "gmail-announced-" + account.Email
+}
+
+func loadAnnounced(account *Account) (announcedState, error) {
+	var announced announcedState
+	if err := account.store().Get(announcedKey(account), &announced); err != nil && !errors.Is(err, state.ErrNotFound) {
+		return announced, err
+	}
+	if announced.Watches == nil {
+		announced.Watches = map[string]map[string]Announcement{}
+	}
+	return announced, nil
+}
+
+func (s announcedState) get(watch, threadID string) (Announcement, bool) {
+	announcement, ok := s.Watches[watch][threadID]
+	return announcement, ok
+}
+
+func (s announcedState) set(watch, threadID string, announcement Announcement) {
+	if s.Watches[watch] == nil {
+		s.Watches[watch] = map[string]Announcement{}
+	}
+	s.Watches[watch][threadID] = announcement
+}
+
+func saveAnnounced(account *Account, announced announcedState) error {
+	cutoff := time.Now().Add(-announcementTTL)
+	for _, threads := range announced.Watches {
+		for id, announcement := range threads {
+			if announcement.UpdatedAt.Before(cutoff) {
+				delete(threads, id)
+			}
+		}
+	}
+
+	if err := account.store().Put(announcedKey(account), announced); err != nil {
+		return fmt.Errorf("failed to save announced gmail threads: %w", err)
+	}
+	return nil
+}
+
+// lastIncoming returns the newest message not sent from the mailbox itself, so our own
+// answers and drafts don't count as replies
+func (t *FullThread) lastIncoming(mailbox string) *FullMessage {
+	for i := len(t.Messages) - 1; i >= 0; i-- {
+		msg := &t.Messages[i]
+		if slices.Contains(msg.LabelIDs, "SENT") || slices.Contains(msg.LabelIDs, "DRAFT") {
+			continue
+		}
+		if msg.From == nil || !strings.EqualFold(msg.From.Address, mailbox) {
+			return msg
+		}
+	}
+	return nil
+}
@@ -4,8 +4,16 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"my-api/admin"
+	"my-api/config"
+	"my-api/logging"
+	"my-api/state"
 	utils "my-api/utils"
-	"os"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"golang.org/x/oauth2"
@@ -14,66 +22,152 @@ import (
 	"google.golang.org/api/option"
 )
 
-var config *oauth2.Config
-var emailUser string
+var oauthConfig *oauth2.Config
+var mainURL string
 
-func InitConfig() error {
-	envs := []struct {
-		name, value string
-	}{
-		{name: "G_CLIENT_ID", value: os.Getenv("G_CLIENT_ID")},
-		{name: "G_SECRET", value: os.Getenv("G_SECRET")},
-		{name: "MAIN_URL", value: os.Getenv("MAIN_URL")},
-		{name: "G_MAIL", value: os.Getenv("G_MAIL")},
+func InitConfig(cfg config.Gmail) error {
+	mainURL = cfg.MainURL
+	stateDir = cfg.StateDir
+	templatesDir = cfg.Templates
+
+	oauthConfig = &oauth2.Config{
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.Secret,
+		RedirectURL:  mainURL + "/auth/callback",
+		Scopes:       []string{gmail.GmailReadonlyScope},
+		Endpoint:     google.Endpoint,
 	}
 
-	values := make(map[string]string)
+	store, err := state.NewFileStore(cfg.StateDir)
+	if err != nil {
+		return err
+	}
+	stateStore = store
 
-	for _, env := range envs {
-		if env.value == "" {
-			return fmt.Errorf("failed to initialize OAuth config: missing %s value", env.name)
-		} else {
-			values[env.name] = env.value
-		}
+	// the label watches check their reply templates against the extraction rules
+	if err := initExtractors(cfg.ExtractRules); err != nil {
+		return err
 	}
 
-	emailUser = values["G_MAIL"]
+	if err := initAccounts(cfg); err != nil {
+		return err
+	}
 
-	config = &oauth2.Config{
-		ClientID:     values["G_CLIENT_ID"],
-		ClientSecret: values["G_SECRET"],
-		RedirectURL:  values["MAIN_URL"] + "/auth/callback",
-		Scopes:       []string{gmail.GmailReadonlyScope},
-		Endpoint:     google.Endpoint,
+	// the OAuth client is only needed for accounts authorized through /auth. Checked here again
+	// since G_ACCOUNTS may pick OAuth for some accounts only
+	if usesOAuth() && (cfg.ClientID == "" || cfg.Secret == "") {
+		return fmt.Errorf("failed to initialize OAuth config: missing G_CLIENT_ID or G_SECRET value")
 	}
 
+	if err := initClassifier(cfg.Classifier); err != nil {
+		return err
+	}
+
+	initPushConfig(cfg)
+
+	for _, account := range accounts {
+		announceSetupLink(context.Background(), account)
+		warnMissingScopes(account)
+	}
 	return nil
 }
 
-func getGmailService(ctx context.Context) (*gmail.Service, error) {
-	token, err := loadToken(ctx)
-	if err != nil {
-		return nil, fmt.Errorf("failed to load token: %w", err)
+// pendingAuth is the server-side half of an OAuth flow started by OAuthHandler
+type pendingAuth struct {
+	account  *Account
+	verifier string // PKCE code verifier
+	expires  time.Time
+}
+
+const authFlowTTL = 10 * time.Minute
+
+var (
+	pendingMu    sync.Mutex
+	pendingAuths = map[string]pendingAuth{}
+)
+
+func startAuthFlow(account *Account) (state, verifier string) {
+	state, verifier = utils.GetRandomState(), oauth2.GenerateVerifier()
+
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	now := time.Now()
+	for s, pending := range pendingAuths {
+		if now.After(pending.expires) {
+			delete(pendingAuths, s)
+		}
 	}
+	pendingAuths[state] = pendingAuth{account: account, verifier: verifier, expires: now.Add(authFlowTTL)}
 
-	client := config.Client(ctx, token.Token)
-	service, err := gmail.NewService(ctx, option.WithHTTPClient(client))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create Gmail service: %w", err)
+	return state, verifier
+}
+
+// finishAuthFlow consumes the state, so every flow can only be completed once
+func finishAuthFlow(state string) (pendingAuth, bool) {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	pending, ok := pendingAuths[state]
+	delete(pendingAuths, state)
+	if !ok || time.Now().After(pending.expires) {
+		return pendingAuth{}, false
 	}
-	return service, nil
+	return pending, true
 }
 
-// ONLY FOR INITIAL 1ST LAUNCH OR WHEN gmail/token.json IS LOST
+// announceSetupLink logs a one-time link to /auth when the account has no token yet
+func announceSetupLink(ctx context.Context, account *Account) {
+	if account.Auth != AuthOAuth {
+		return
+	}
+	if _, err := account.tokens.Load(ctx); !errors.Is(err, ErrNoToken) {
+		return
+	}
+
+	code := admin.NewSetupCode(1 * time.Hour)
+	slog.Warn("No Gmail token stored yet. Authorize the mailbox within an hour using this one-time link",
+		slog.String("account", account.Name),
+		slog.String("url", fmt.Sprintf("%s/auth?account=%s&setup_code=%s",
+			mainURL, url.QueryEscape(account.Name), url.QueryEscape(code))))
+}
+
+// ONLY FOR INITIAL 1ST LAUNCH, WHEN THE TOKEN IS LOST OR TO GRANT MORE SCOPES. Requires admin auth or a setup code.
+// Pick the mailbox with ?account=<name>, optional when only one account is configured.
+// Extra scopes are requested with ?scope=send, keeping the ones granted before (incremental consent).
 // DONT FORGET! Change OAuthCallback url in Google Cloud in production
 func OAuthHandler(ctx *gin.Context) {
-	state := utils.GetRandomState()
-	ctx.SetCookie("oauth_state", state, 3600, "/", "", false, true) // Keep state cookie for safety
-	url := config.AuthCodeURL(state, oauth2.AccessTypeOffline)
+	account, err := AccountByName(ctx.Query("account"))
+	if err != nil {
+		ctx.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if account.Auth != AuthOAuth {
+		ctx.JSON(400, gin.H{"error": fmt.Sprintf("gmail account %q uses %s auth and needs no consent", account.Name, account.Auth)})
+		return
+	}
+
+	scopes, err := resolveScopes(ctx.QueryArray("scope"))
+	if err != nil {
+		ctx.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	state, verifier := startAuthFlow(account)
+	secure := strings.HasPrefix(mainURL, "https://")
+	ctx.SetCookie("oauth_state", state, int(authFlowTTL.Seconds()), "/auth", "", secure, true) // binds the flow to this browser
+	url := oauthConfig.AuthCodeURL(state,
+		oauth2.AccessTypeOffline,
+		oauth2.S256ChallengeOption(verifier),
+		oauth2.SetAuthURLParam("prompt", "consent"),
+		oauth2.SetAuthURLParam("login_hint", account.Email),
+		oauth2.SetAuthURLParam("scope", strings.Join(scopes, " ")),
+		oauth2.SetAuthURLParam("include_granted_scopes", "true"),
+	)
 	ctx.Redirect(302, url)
 }
 
-func exchangeToken(ctx *gin.Context) (*Token, error) {
+func exchangeToken(ctx *gin.Context, verifier string) (*Token, error) {
 	code := ctx.Query("code")
 	if code == "" {
 		return nil, &utils.APIError{
@@ -82,7 +176,7 @@ func exchangeToken(ctx *gin.Context) (*Token, error) {
 		}
 	}
 
-	token, err := config.Exchange(ctx.Request.Context(), code)
+	token, err := oauthConfig.Exchange(ctx.Request.Context(), code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		return nil, &utils.APIError{
 			Err:    fmt.Errorf("failed to exchange oAuth tokens: %w", err),
@@ -93,18 +187,55 @@ func exchangeToken(ctx *gin.Context) (*Token, error) {
 	return &Token{Token: token}, nil
 }
 
+// verifyTokenAccount makes sure the token belongs to the account's mailbox and not whichever
+// Google account happened to be signed in during the consent screen
+func verifyTokenAccount(ctx context.Context, account *Account, token *Token) error {
+	client := oauthConfig.Client(ctx, token.Token)
+	service, err := gmail.NewService(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return &utils.APIError{Err: fmt.Errorf("failed to create Gmail service: %w", err), Status: 500}
+	}
+
+	profile, err := service.Users.GetProfile("me").Context(ctx).Do()
+	if err != nil {
+		return &utils.APIError{Err: fmt.Errorf("failed to get gmail profile: %w", err), Status: 500}
+	}
+
+	if !strings.EqualFold(profile.EmailAddress, account.Email) {
+		return &utils.APIError{
+			Err:    fmt.Errorf("authorized account %s is not the configured mailbox %s", profile.EmailAddress, account.Email),
+			Status: 403,
+		}
+	}
+
+	return nil
+}
+
 func OAuthCallback(ctx *gin.Context) {
 	state := ctx.Query("state")
 	cookieState, err := ctx.Cookie("oauth_state")
 	if err != nil || state != cookieState {
-		ctx.JSON(500, gin.H{"error": "Mismatch between recieved and saved state"})
+		ctx.JSON(400, gin.H{"error": "Mismatch between recieved and saved state"})
 		return
 	}
+	ctx.SetCookie("oauth_state", "", -1, "/auth", "", strings.HasPrefix(mainURL, "https://"), true)
 
-	token, err := exchangeToken(ctx)
+	pending, ok := finishAuthFlow(state)
+	if !ok {
+		ctx.JSON(400, gin.H{"error": "Unknown or expired OAuth state, start again at /auth"})
+		return
+	}
+	account := pending.account
+
+	token, err := exchangeToken(ctx, pending.verifier)
+	if err == nil {
+		err = verifyTokenAccount(ctx.Request.Context(), account, token)
+	}
 	if err != nil {
+		logging.From(ctx).Warn("OAuth callback failed", slog.Any("error", err))
+
 		var apiErr *utils.APIError
-		if errors.As(err, &apiErr) {
+		if errors.As(err, &apiErr) && apiErr.Status != 500 {
 			ctx.JSON(apiErr.Status, gin.H{"error": apiErr.Error()})
 			return
 		}
@@ -113,10 +244,18 @@ func OAuthCallback(ctx *gin.Context) {
 		return
 	}
 
-	if err := token.Save(); err != nil {
-		ctx.JSON(500, gin.H{"error": fmt.Errorf("failed to save token: %w", err)})
+	if err := token.Save(ctx.Request.Context(), account); err != nil {
+		logging.From(ctx).Error("Failed to save OAuth token", slog.String("account", account.Name), slog.Any("error", err))
+		ctx.JSON(500, gin.H{"error": "Failed to save token"})
 		return
 	}
 
-	ctx.JSON(200, gin.H{"message": "Authentication was successful"})
+	if err := account.recordGrantedScopes(token.Token); err != nil {
+		logging.From(ctx).Error("Failed to save granted Gmail scopes", slog.String("account", account.Name), slog.Any("error", err))
+	}
+
+	account.source.replace(token.Token)
+	recordTokenHealth(ctx.Request.Context(), account, nil, token.Expiry)
+
+	ctx.JSON(200, gin.H{"message": fmt.Sprintf("Authentication of %s was successful", account.Email)})
 }
@@ -0,0 +1,180 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"my-api/state"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// BayesModel is a multinomial naive Bayes model over the words of subject and body.
+// The class "" stands for mail that gets no label.
+type BayesModel struct {
+	Classes map[string]*bayesClass `json:"classes"`
+	Vocab   int                    `json:"vocab"`
+}
+
+type bayesClass struct {
+	Docs  int            `json:"docs"`
+	Total int            `json:"total"`
+	Words map[string]int `json:"words"`
+}
+
+func tokenize(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := words[:0]
+	for _, word := range words {
+		if len([]rune(word)) >= 3 {
+			tokens = append(tokens, word)
+		}
+	}
+	return tokens
+}
+
+func LoadBayesModel(path string) (*BayesModel, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read classifier model: %w", err)
+	}
+
+	var model BayesModel
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, fmt.Errorf("failed to parse classifier model %s: %w", path, err)
+	}
+	if len(model.Classes) < 2 {
+		return nil, fmt.Errorf("classifier model %s needs at least two classes", path)
+	}
+	return &model, nil
+}
+
+func (m *BayesModel) Save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal classifier model: %w", err)
+	}
+	return state.WriteFileAtomic(path, data, 0600)
+}
+
+func (m *BayesModel) add(class, text string) {
+	c := m.Classes[class]
+	if c == nil {
+		c = &bayesClass{Words: map[string]int{}}
+		m.Classes[class] = c
+	}
+
+	c.Docs++
+	for _, token := range tokenize(text) {
+		c.Words[token]++
+		c.Total++
+	}
+}
+
+// Predict returns the most likely class and its probability
+func (m *BayesModel) Predict(text string) (string, float64) {
+	docs := 0
+	for _, c := range m.Classes {
+		docs += c.Docs
+	}
+
+	tokens := tokenize(text)
+	scores := make(map[string]float64, len(m.Classes))
+	best, bestScore := "", math.Inf(-1)
+	for name, c := range m.Classes {
+		score := math.Log(float64(c.Docs) / float64(docs))
+		for _, token := range tokens {
+			// Laplace smoothing so unseen words don't zero out a class
+			score += math.Log(float64(c.Words[token]+1) / float64(c.Total+m.Vocab))
+		}
+		scores[name] = score
+		if score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+
+	// softmax over the log scores
+	var sum float64
+	for _, score := range scores {
+		sum += math.Exp(score - bestScore)
+	}
+	return best, 1 / sum
+}
+
+// TrainBayes builds a model from the threads currently in the given labels, with inbox mail
+// in none of them as the "no label" class. At most limit threads are read per class.
+func TrainBayes(ctx context.Context, account *Account, labels []string, limit int) (*BayesModel, error) {
+	client, err := account.mailClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	model := &BayesModel{Classes: map[string]*bayesClass{}}
+	labelled := map[string]bool{}
+
+	train := func(class, labelID string) error {
+		// the inbox skips threads seen in a label, so it may need that many more
+		listLimit := limit
+		if limit > 0 && class == "" {
+			listLimit += len(labelled)
+		}
+		threads, err := client.ListThreads(ctx, labelID, "", listLimit)
+		if err != nil {
+			return fmt.Errorf("failed to list threads of %q: %w", class, err)
+		}
+
+		var ids []string
+		for _, thread := range threads {
+			if class == "" && labelled[thread.Id] {
+				continue
+			}
+			labelled[thread.Id] = true
+			ids = append(ids, thread.Id)
+			if limit > 0 && len(ids) >= limit {
+				break
+			}
+		}
+
+		full, err := GetFullThreads(ctx, client, ids)
+		if err != nil {
+			return err
+		}
+		for _, thread := range full {
+			if msg := thread.First(); msg != nil {
+				model.add(class, msg.Subject+"\n"+msg.Body)
+			}
+		}
+		return nil
+	}
+
+	for _, label := range labels {
+		labelID, err := getLabelID(ctx, client, label)
+		if err != nil {
+			return nil, err
+		}
+		if err := train(label, labelID); err != nil {
+			return nil, err
+		}
+	}
+	if err := train("", "INBOX"); err != nil {
+		return nil, err
+	}
+
+	vocab := map[string]bool{}
+	for _, c := range model.Classes {
+		for word := range c.Words {
+			vocab[word] = true
+		}
+	}
+	model.Vocab = len(vocab)
+
+	if len(model.Classes) < 2 {
+		return nil, fmt.Errorf("not enough mail to train on")
+	}
+	return model, nil
+}
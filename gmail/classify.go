@@ -0,0 +1,315 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"my-api/logging"
+	"my-api/slack"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ClassifyRule labels mail matching all of its conditions. Within a list any entry may match.
+type ClassifyRule struct {
+	Name     string   `json:"name"`
+	From     []string `json:"from,omitempty"`     // sender address, or "@domain"
+	Subject  []string `json:"subject,omitempty"`  // subject keywords
+	Keywords []string `json:"keywords,omitempty"` // body keywords
+	Pattern  string   `json:"pattern,omitempty"`  // regex on subject and body
+	Label    string   `json:"label"`
+	Channel  string   `json:"channel,omitempty"` // Slack channel that also gets a note, e.g. "internal-notifications"
+
+	pattern *regexp.Regexp
+}
+
+// ClassifierConfig is read from the JSON file in G_CLASSIFIER. Rules are tried in order, the
+// Bayes model (see TrainBayes) only decides mail no rule matched.
+type ClassifierConfig struct {
+	Schedule string         `json:"schedule,omitempty"` // cron with seconds, defaults to every 10 minutes
+	DryRun   bool           `json:"dry_run,omitempty"`  // only log what would be labelled
+	Rules    []ClassifyRule `json:"rules"`
+	Bayes    *BayesConfig   `json:"bayes,omitempty"`
+}
+
+type BayesConfig struct {
+	Model     string  `json:"model"`               // file written by "./api train-classifier"
+	Threshold float64 `json:"threshold,omitempty"` // minimum probability, defaults to 0.9
+	Channel   string  `json:"channel,omitempty"`
+}
+
+// Classification is the decision for one thread, Label is empty if nothing matched
+type Classification struct {
+	ThreadID string  `json:"thread_id"`
+	From     string  `json:"from"`
+	Subject  string  `json:"subject"`
+	Label    string  `json:"label,omitempty"`
+	Channel  string  `json:"channel,omitempty"`
+	Source   string  `json:"source,omitempty"` // rule name or "bayes"
+	Score    float64 `json:"score,omitempty"`  // Bayes probability
+}
+
+// classifierWatch is the cursor the classifier keeps per account, a pseudo label watch on the inbox.
+// Label watches can't use the name, see validateLabelWatches.
+const classifierWatch = "classifier"
+
+var classifier *ClassifierConfig
+var bayesModel *BayesModel
+
+// initClassifier loads the optional G_CLASSIFIER file at path
+func initClassifier(path string) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read G_CLASSIFIER file: %w", err)
+	}
+
+	var cfg ClassifierConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("failed to parse G_CLASSIFIER file: %w", err)
+	}
+
+	if cfg.Schedule == "" {
+		cfg.Schedule = "0 */10 * * * *"
+	}
+	if _, err := scheduleParser.Parse(cfg.Schedule); err != nil {
+		return fmt.Errorf("classifier: invalid schedule %q: %w", cfg.Schedule, err)
+	}
+
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if rule.Name == "" || rule.Label == "" {
+			return fmt.Errorf("classifier rule #%d: name and label are required", i+1)
+		}
+		if len(rule.From) == 0 && len(rule.Subject) == 0 && len(rule.Keywords) == 0 && rule.Pattern == "" {
+			return fmt.Errorf("classifier rule %q has no conditions", rule.Name)
+		}
+		if rule.Pattern != "" {
+			if rule.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return fmt.Errorf("classifier rule %q: invalid pattern: %w", rule.Name, err)
+			}
+		}
+		if rule.Channel != "" {
+			if _, err := slack.ChannelByName(rule.Channel); err != nil {
+				return fmt.Errorf("classifier rule %q: %w", rule.Name, err)
+			}
+		}
+	}
+
+	if cfg.Bayes != nil {
+		if cfg.Bayes.Threshold == 0 {
+			cfg.Bayes.Threshold = 0.9
+		}
+		if bayesModel, err = LoadBayesModel(cfg.Bayes.Model); err != nil {
+			return err
+		}
+		if cfg.Bayes.Channel != "" {
+			if _, err := slack.ChannelByName(cfg.Bayes.Channel); err != nil {
+				return fmt.Errorf("classifier bayes: %w", err)
+			}
+		}
+	}
+
+	classifier = &cfg
+	return nil
+}
+
+// ClassifierEnabled reports whether G_CLASSIFIER is set
+func ClassifierEnabled() bool {
+	return classifier != nil
+}
+
+// ClassifierSchedule is the cron schedule of the classifier job
+func ClassifierSchedule() string {
+	return classifier.Schedule
+}
+
+func containsAny(text string, keywords []string) bool {
+	for _, keyword := range keywords {
+		if strings.Contains(text, strings.ToLower(keyword)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ClassifyRule) matches(msg *FullMessage) bool {
+	if len(r.From) > 0 {
+		sender := ""
+		if msg.From != nil {
+			sender = strings.ToLower(msg.From.Address)
+		}
+
+		matched := false
+		for _, from := range r.From {
+			from = strings.ToLower(from)
+			if sender == from || (strings.HasPrefix(from, "@") && strings.HasSuffix(sender, from)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Subject) > 0 && !containsAny(strings.ToLower(msg.Subject), r.Subject) {
+		return false
+	}
+	if len(r.Keywords) > 0 && !containsAny(strings.ToLower(msg.Body), r.Keywords) {
+		return false
+	}
+	if r.pattern != nil && !r.pattern.MatchString(msg.Subject+"\n"+msg.Body) {
+		return false
+	}
+
+	return true
+}
+
+// Classify decides on the label of a thread from its first message
+func Classify(thread *FullThread) Classification {
+	result := Classification{ThreadID: thread.ID, Subject: thread.Subject}
+
+	msg := thread.First()
+	if msg == nil || classifier == nil {
+		return result
+	}
+	result.From = msg.Sender()
+
+	for i := range classifier.Rules {
+		rule := &classifier.Rules[i]
+		if rule.matches(msg) {
+			result.Label, result.Channel, result.Source = rule.Label, rule.Channel, rule.Name
+			return result
+		}
+	}
+
+	if bayesModel != nil {
+		label, score := bayesModel.Predict(msg.Subject + "\n" + msg.Body)
+		result.Score = score
+		if label != "" && score >= classifier.Bayes.Threshold {
+			result.Label, result.Channel, result.Source = label, classifier.Bayes.Channel, "bayes"
+		}
+	}
+
+	return result
+}
+
+// ClassifyNew labels the inbox threads that arrived since the last run. Labelled threads are
+// then picked up by the label watches like hand-labelled ones.
+func ClassifyNew(ctx context.Context, account *Account) error {
+	if classifier == nil {
+		return nil
+	}
+
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+
+	client, err := account.mailClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	watch := LabelWatch{Name: classifierWatch, Label: "INBOX"}
+	threads, next, err := GetThreadsForWatch(ctx, client, account, watch)
+	if err != nil {
+		return fmt.Errorf("failed to list new inbox threads: %w", err)
+	}
+	if len(threads) == 0 {
+		return commitCursor(ctx, account, watch, next)
+	}
+
+	threadIDs := make([]string, 0, len(threads))
+	for _, thread := range threads {
+		threadIDs = append(threadIDs, thread.Id)
+	}
+
+	fullThreads, err := GetFullThreads(ctx, client, threadIDs)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	for _, thread := range fullThreads {
+		result := Classify(thread)
+		if result.Label == "" {
+			continue
+		}
+
+		logger := logging.From(ctx).With(slog.String("account", account.Name), slog.String("thread", thread.ID),
+			slog.String("label", result.Label), slog.String("source", result.Source))
+		if classifier.DryRun {
+			logger.Info("Classifier would label thread (dry run)")
+			continue
+		}
+
+		if err := applyThreadActions(ctx, client, account, LabelWatch{Name: classifierWatch, Actions: ThreadActions{
+			AddLabels: []string{result.Label},
+		}}, []string{thread.ID}); err != nil {
+			logger.Error("Classifier failed to label thread", slog.Any("error", err))
+			failed++
+			continue
+		}
+		logger.Info("Classifier labelled thread")
+
+		if result.Channel != "" {
+			notifyClassification(ctx, account, result)
+		}
+	}
+
+	// the cursor stays put when a thread couldn't be labelled, so the next run classifies it again
+	if failed > 0 {
+		return fmt.Errorf("classifier failed to label %d of %d threads", failed, len(fullThreads))
+	}
+	return commitCursor(ctx, account, watch, next)
+}
+
+func notifyClassification(ctx context.Context, account *Account, result Classification) {
+	channel, err := slack.ChannelByName(result.Channel)
+	if err != nil {
+		logging.From(ctx).Error("Unknown classifier channel", slog.Any("error", err))
+		return
+	}
+
+	text := fmt.Sprintf("*Mail labelled %s*\n<%s/%s|%s>\nFrom: %s",
+		result.Label, account.permalink(result.Label), result.ThreadID, result.Subject, result.From)
+	if err := channel.Send(ctx, *slack.NewMessage(text)); err != nil {
+		logging.From(ctx).Error("Failed to send classifier note", slog.Any("error", err))
+	}
+}
+
+// ClassifyReport classifies the inbox threads of the last period without changing anything
+func ClassifyReport(ctx context.Context, account *Account, since time.Duration) ([]Classification, error) {
+	client, err := account.mailClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	query := fmt.Sprintf("after:%d", time.Now().Add(-since).Unix())
+	threads, err := client.ListThreads(ctx, "INBOX", query, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list inbox threads: %w", err)
+	}
+
+	threadIDs := make([]string, 0, len(threads))
+	for _, thread := range threads {
+		threadIDs = append(threadIDs, thread.Id)
+	}
+
+	fullThreads, err := GetFullThreads(ctx, client, threadIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	report := make([]Classification, 0, len(fullThreads))
+	for _, thread := range fullThreads {
+		report = append(report, Classify(thread))
+	}
+	return report, nil
+}
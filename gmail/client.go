@@ -0,0 +1,155 @@
+package gmail
+
+import (
+	"context"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// MailClient is the part of the Gmail API the sync, actions and send code use, always for the
+// authorized mailbox ("me"). List calls return every page. Errors should be *googleapi.Error
+// where a status code matters, e.g. 404 for expired history or deleted threads.
+type MailClient interface {
+	Profile(ctx context.Context) (*gmail.Profile, error)
+
+	ListLabels(ctx context.Context) ([]*gmail.Label, error)
+	CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error)
+
+	// ListThreads lists the threads with the label matching a Gmail search query, newest first.
+	// limit stops listing after that many threads, 0 lists all.
+	ListThreads(ctx context.Context, labelID, query string, limit int) ([]*gmail.Thread, error)
+	// GetThread fetches a thread in the "minimal" or "full" format
+	GetThread(ctx context.Context, id, format string) (*gmail.Thread, error)
+	ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) error
+
+	// ListHistory returns the "messageAdded" and "labelAdded" records of the label since startID,
+	// and the mailbox's current history ID
+	ListHistory(ctx context.Context, labelID string, startID uint64) ([]*gmail.History, uint64, error)
+
+	SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error)
+	CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error)
+	DeleteDraft(ctx context.Context, id string) error
+	Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error)
+}
+
+// serviceClient talks to the real Gmail API. Every request, including each page of a list,
+// is retried on rate limits and server errors, see withRetry.
+type serviceClient struct {
+	service *gmail.Service
+}
+
+func (c *serviceClient) Profile(ctx context.Context) (*gmail.Profile, error) {
+	return withRetry(ctx, "users.getProfile", func() (*gmail.Profile, error) {
+		return c.service.Users.GetProfile("me").Context(ctx).Do()
+	})
+}
+
+func (c *serviceClient) ListLabels(ctx context.Context) ([]*gmail.Label, error) {
+	res, err := withRetry(ctx, "labels.list", func() (*gmail.ListLabelsResponse, error) {
+		return c.service.Users.Labels.List("me").Context(ctx).Do()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Labels, nil
+}
+
+func (c *serviceClient) CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error) {
+	return withRetry(ctx, "labels.create", func() (*gmail.Label, error) {
+		return c.service.Users.Labels.Create("me", label).Context(ctx).Do()
+	})
+}
+
+func (c *serviceClient) ListThreads(ctx context.Context, labelID, query string, limit int) ([]*gmail.Thread, error) {
+	var threads []*gmail.Thread
+	pageSize := int64(500)
+	if limit > 0 && limit < 500 {
+		pageSize = int64(limit)
+	}
+	pageToken := ""
+	for {
+		res, err := withRetry(ctx, "threads.list", func() (*gmail.ListThreadsResponse, error) {
+			return c.service.Users.Threads.List("me").LabelIds(labelID).Q(query).MaxResults(pageSize).
+				PageToken(pageToken).Context(ctx).Do()
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		threads = append(threads, res.Threads...)
+		if limit > 0 && len(threads) >= limit {
+			return threads[:limit], nil
+		}
+		if res.NextPageToken == "" {
+			return threads, nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+func (c *serviceClient) GetThread(ctx context.Context, id, format string) (*gmail.Thread, error) {
+	return withRetry(ctx, "threads.get", func() (*gmail.Thread, error) {
+		return c.service.Users.Threads.Get("me", id).Format(format).Context(ctx).Do()
+	})
+}
+
+func (c *serviceClient) ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) error {
+	_, err := withRetry(ctx, "threads.modify", func() (*gmail.Thread, error) {
+		return c.service.Users.Threads.Modify("me", id, req).Context(ctx).Do()
+	})
+	return err
+}
+
+func (c *serviceClient) ListHistory(ctx context.Context, labelID string, startID uint64) ([]*gmail.History, uint64, error) {
+	var history []*gmail.History
+	latest := startID
+	pageToken := ""
+	for {
+		res, err := withRetry(ctx, "history.list", func() (*gmail.ListHistoryResponse, error) {
+			return c.service.Users.History.List("me").
+				StartHistoryId(startID).
+				LabelId(labelID).
+				HistoryTypes("messageAdded", "labelAdded").
+				MaxResults(500).
+				PageToken(pageToken).
+				Context(ctx).Do()
+		})
+		if err != nil {
+			return nil, startID, err
+		}
+
+		latest = max(latest, res.HistoryId)
+		history = append(history, res.History...)
+		if res.NextPageToken == "" {
+			return history, latest, nil
+		}
+		pageToken = res.NextPageToken
+	}
+}
+
+// SendMessage isn't retried, a request that timed out on our side may still have been sent
+func (c *serviceClient) SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	sent, err := c.service.Users.Messages.Send("me", msg).Context(ctx).Do()
+	observeCall("messages.send", err)
+	return sent, err
+}
+
+// CreateDraft isn't retried either, a retry could leave a duplicate draft behind
+func (c *serviceClient) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	created, err := c.service.Users.Drafts.Create("me", draft).Context(ctx).Do()
+	observeCall("drafts.create", err)
+	return created, err
+}
+
+func (c *serviceClient) DeleteDraft(ctx context.Context, id string) error {
+	_, err := withRetry(ctx, "drafts.delete", func() (struct{}, error) {
+		return struct{}{}, c.service.Users.Drafts.Delete("me", id).Context(ctx).Do()
+	})
+	return err
+}
+
+func (c *serviceClient) Watch(ctx context.Context, req *gmail.WatchRequest) (*gmail.WatchResponse, error) {
+	return withRetry(ctx, "users.watch", func() (*gmail.WatchResponse, error) {
+		return c.service.Users.Watch("me", req).Context(ctx).Do()
+	})
+}
@@ -0,0 +1,127 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"my-api/logging"
+	"net/mail"
+	"net/url"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// DraftData is what a label watch's draft and acknowledgement templates get: the parsed
+// request fields by name (see FieldRule) and who to greet
+type DraftData struct {
+	Name    string
+	Subject string
+	Fields  map[string]string
+}
+
+func draftData(watch LabelWatch, thread *FullThread) DraftData {
+	data := DraftData{Subject: thread.Subject, Fields: map[string]string{}}
+	if first := thread.First(); first != nil {
+		if extractor := ExtractorFor(watch.Label); extractor != nil {
+			for _, field := range extractor.Extract(first.Body).Fields {
+				data.Fields[field.Name] = field.Value
+			}
+		}
+		if first.From != nil {
+			data.Name = first.From.Name
+		}
+	}
+	if name := data.Fields["contact_name"]; name != "" {
+		data.Name = name
+	}
+	return data
+}
+
+// checkReplyTemplate renders the template with every field the label's extractor knows, failing on
+// parse errors, unknown DraftData fields and .Fields keys no extraction rule produces
+func checkReplyTemplate(name string, extractor *Extractor) error {
+	data := DraftData{Name: "name", Subject: "subject", Fields: map[string]string{}}
+	if extractor != nil {
+		for _, rule := range extractor.rules {
+			data.Fields[rule.Name] = rule.Name
+		}
+	}
+	if _, err := renderEmail(name, data, "missingkey=error"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// createDraftReply saves a reply to the thread as a Gmail draft, rendered from the watch's Draft template
+func createDraftReply(ctx context.Context, client MailClient, account *Account, watch LabelWatch, thread *FullThread) (*gmail.Draft, error) {
+	if err := account.requireScope(gmail.GmailComposeScope, gmail.GmailModifyScope); err != nil {
+		return nil, err
+	}
+
+	reply, err := Reply(thread, account.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	rendered, err := RenderEmail(watch.Draft, draftData(watch, thread))
+	if err != nil {
+		return nil, err
+	}
+	reply.Text, reply.HTML = rendered.Text, rendered.HTML
+
+	raw, err := BuildMIME(&mail.Address{Address: account.Email}, reply)
+	if err != nil {
+		return nil, err
+	}
+
+	draft, err := client.CreateDraft(ctx, &gmail.Draft{Message: &gmail.Message{
+		Raw:      base64.URLEncoding.EncodeToString(raw),
+		ThreadId: thread.ID,
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create draft reply to %s: %w", thread.ID, err)
+	}
+
+	return draft, nil
+}
+
+func draftLink(account *Account, draft *gmail.Draft) string {
+	return fmt.Sprintf("https://mail.google.com/mail/u/%s/#drafts?compose=%s",
+		url.PathEscape(account.PermalinkUser), url.QueryEscape(draft.Message.Id))
+}
+
+// createDraftReplies drafts a reply for each thread and returns the drafts by thread ID.
+// A failed draft is only logged, the request still gets announced without it.
+func createDraftReplies(ctx context.Context, client MailClient, account *Account, watch LabelWatch, threads []*FullThread) map[string]*gmail.Draft {
+	drafts := map[string]*gmail.Draft{}
+	if watch.Draft == "" {
+		return drafts
+	}
+
+	for _, thread := range threads {
+		if thread.lastIncoming(account.Email) == nil {
+			continue
+		}
+		draft, err := createDraftReply(ctx, client, account, watch, thread)
+		if err != nil {
+			logging.From(ctx).Error("Failed to draft a reply", slog.String("watch", watch.Name), slog.String("thread", thread.ID), slog.Any("error", err))
+			if _, ok := err.(*ScopeError); ok {
+				break // same for every thread
+			}
+			continue
+		}
+		drafts[thread.ID] = draft
+	}
+
+	return drafts
+}
+
+// deleteDrafts removes drafts whose announcement failed, the next sync drafts them again
+func deleteDrafts(ctx context.Context, client MailClient, drafts map[string]*gmail.Draft) {
+	for threadID, draft := range drafts {
+		if err := client.DeleteDraft(ctx, draft.Id); err != nil {
+			logging.From(ctx).Error("Failed to delete an unannounced draft", slog.String("thread", threadID), slog.String("draft", draft.Id), slog.Any("error", err))
+		}
+	}
+}
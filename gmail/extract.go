@@ -0,0 +1,226 @@
+package gmail
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// FieldRule describes how to pull one field out of a request email. Keys are tried first
+// ("Key: value" on one line, or the key alone followed by the value on the next line),
+// then Pattern, whose first capture group (or whole match) becomes the value.
+type FieldRule struct {
+	Name     string   `json:"name"`
+	Title    string   `json:"title"`
+	Keys     []string `json:"keys,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	Required bool     `json:"required,omitempty"`
+}
+
+// LabelRules are the extraction rules for mail in one label
+type LabelRules struct {
+	Label  string      `json:"label"`
+	Fields []FieldRule `json:"fields"`
+}
+
+type ExtractedField struct {
+	Name, Title, Value string
+}
+
+type Extracted struct {
+	Fields  []ExtractedField
+	Missing []string // titles of required fields that weren't found
+}
+
+type compiledRule struct {
+	FieldRule
+	keys    []*regexp.Regexp
+	pattern *regexp.Regexp
+}
+
+type Extractor struct {
+	rules []compiledRule
+}
+
+// defaultRules match the FoodSpot request form. G_EXTRACT_RULES can point to a JSON file
+// with a list of LabelRules to replace them or add other labels.
+var defaultRules = []LabelRules{
+	{
+		Label: "Mangopost/FoodSpot Requests",
+		Fields: []FieldRule{
+			{Name: "contact_name", Title: "Contact", Keys: []string{"contact name", "contact person", "name", "your name"}, Required: true},
+			{Name: "phone", Title: "Phone", Keys: []string{"phone", "phone number", "telephone", "tel", "mobile"}, Pattern: `(\+?\d[\d \-/()]{6,}\d)`, Required: true},
+			{Name: "event_date", Title: "Event date", Keys: []string{"event date", "date of event", "date"}, Pattern: `\b(\d{1,2}[./-]\d{1,2}[./-]\d{2,4})\b`, Required: true},
+			{Name: "guest_count", Title: "Guests", Keys: []string{"guest count", "number of guests", "guests", "persons", "people", "pax"}, Pattern: `(?i)\b(\d{1,5})\s*(?:guests|people|persons|pax)\b`, Required: true},
+			{Name: "location", Title: "Location", Keys: []string{"location", "venue", "event location", "address"}},
+			{Name: "budget", Title: "Budget", Keys: []string{"budget"}, Pattern: `(?i)(\d[\d.,]*\s*(?:€|eur|euro))`},
+		},
+	},
+}
+
+var extractors map[string]*Extractor
+
+// initExtractors loads the rules of the optional G_EXTRACT_RULES file at path
+func initExtractors(path string) error {
+	rules := defaultRules
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read G_EXTRACT_RULES file: %w", err)
+		}
+
+		var custom []LabelRules
+		if err := json.Unmarshal(data, &custom); err != nil {
+			return fmt.Errorf("failed to parse G_EXTRACT_RULES file: %w", err)
+		}
+		rules = mergeRules(rules, custom)
+	}
+
+	extractors = make(map[string]*Extractor, len(rules))
+	for _, labelRules := range rules {
+		extractor, err := NewExtractor(labelRules.Fields)
+		if err != nil {
+			return fmt.Errorf("invalid extraction rules for %q: %w", labelRules.Label, err)
+		}
+		extractors[labelRules.Label] = extractor
+	}
+
+	return nil
+}
+
+// mergeRules replaces the rules of labels present in custom and appends the rest
+func mergeRules(base, custom []LabelRules) []LabelRules {
+	merged := append([]LabelRules{}, base...)
+	for _, labelRules := range custom {
+		replaced := false
+		for i := range merged {
+			if merged[i].Label == labelRules.Label {
+				merged[i] = labelRules
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, labelRules)
+		}
+	}
+	return merged
+}
+
+// ExtractorFor returns the extractor configured for a label, or nil if there are no rules
+func ExtractorFor(labelName string) *Extractor {
+	return extractors[labelName]
+}
+
+func NewExtractor(fields []FieldRule) (*Extractor, error) {
+	e := &Extractor{}
+	for _, field := range fields {
+		if field.Name == "" {
+			return nil, fmt.Errorf("field rule without name")
+		}
+		if field.Title == "" {
+			field.Title = field.Name
+		}
+
+		rule := compiledRule{FieldRule: field}
+		for _, key := range field.Keys {
+			// "Key: value", "Key = value", "Key - value" or "Key" alone on its line
+			keyRe, err := regexp.Compile(`(?im)^[ \t*_]*` + regexp.QuoteMeta(key) + `[ \t*_]*(?:[:=\-–][ \t]*(.*))?$`)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: invalid key %q: %w", field.Name, key, err)
+			}
+			rule.keys = append(rule.keys, keyRe)
+		}
+
+		if field.Pattern != "" {
+			pattern, err := regexp.Compile(field.Pattern)
+			if err != nil {
+				return nil, fmt.Errorf("field %q: invalid pattern: %w", field.Name, err)
+			}
+			rule.pattern = pattern
+		}
+
+		e.rules = append(e.rules, rule)
+	}
+
+	return e, nil
+}
+
+func (e *Extractor) Extract(body string) Extracted {
+	var extracted Extracted
+	lines := strings.Split(body, "\n")
+
+	for _, rule := range e.rules {
+		value := rule.matchKeys(body, lines, e.isKey)
+		if value == "" && rule.pattern != nil {
+			if match := rule.pattern.FindStringSubmatch(body); match != nil {
+				value = match[len(match)-1]
+			}
+		}
+
+		value = strings.TrimSpace(value)
+		if value != "" {
+			extracted.Fields = append(extracted.Fields, ExtractedField{Name: rule.Name, Title: rule.Title, Value: value})
+		} else if rule.Required {
+			extracted.Missing = append(extracted.Missing, rule.Title)
+		}
+	}
+
+	return extracted
+}
+
+func (r compiledRule) matchKeys(body string, lines []string, isKey func(string) bool) string {
+	for _, key := range r.keys {
+		loc := key.FindStringSubmatchIndex(body)
+		if loc == nil {
+			continue
+		}
+
+		// "Key:" with nothing after the separator is an empty field, not a form layout
+		if loc[2] >= 0 {
+			if value := body[loc[2]:loc[3]]; strings.TrimSpace(value) != "" {
+				return value
+			}
+			continue
+		}
+
+		// form layout with the value on the following non-empty line, unless that's the next key
+		lineNo := strings.Count(body[:loc[0]], "\n")
+		for _, line := range lines[lineNo+1:] {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if isKey(line) {
+				break
+			}
+			return line
+		}
+	}
+
+	return ""
+}
+
+// isKey tells whether the line starts any field of the extractor
+func (e *Extractor) isKey(line string) bool {
+	line = strings.TrimRight(line, "\r")
+	for _, rule := range e.rules {
+		for _, key := range rule.keys {
+			if key.MatchString(line) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Get returns the value of an extracted field by name
+func (e Extracted) Get(name string) string {
+	for _, field := range e.Fields {
+		if field.Name == name {
+			return field.Value
+		}
+	}
+	return ""
+}
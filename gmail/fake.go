@@ -0,0 +1,483 @@
+package gmail
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"my-api/logging"
+	"my-api/state"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// AuthFake serves the account from an in-memory FakeMailbox instead of Gmail, for running the jobs locally
+const AuthFake = "fake"
+
+// FakeSeed is the JSON file an AuthFake account starts with
+type FakeSeed struct {
+	Labels  []string         `json:"labels"`
+	Threads []FakeSeedThread `json:"threads"`
+}
+
+type FakeSeedThread struct {
+	Labels   []string      `json:"labels"` // label names, created if missing
+	Messages []FakeMessage `json:"messages"`
+}
+
+// FakeMessage is a message to put into a FakeMailbox. Date defaults to now.
+type FakeMessage struct {
+	From    string    `json:"from"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Text    string    `json:"text"`
+	HTML    string    `json:"html,omitempty"`
+	Date    time.Time `json:"date,omitzero"`
+}
+
+// FakeMailbox is an in-memory MailClient. It keeps labels per message like Gmail and records
+// history for new messages and added labels. Search queries only support "after:<unix>",
+// other terms match everything.
+type FakeMailbox struct {
+	email string
+
+	mu        sync.Mutex
+	labels    map[string]*gmail.Label     // by ID
+	threads   map[string][]*gmail.Message // full format, oldest first
+	history   []*gmail.History
+	drafts    map[string]string // message ID by draft ID
+	historyID uint64
+	nextID    int
+}
+
+var systemLabels = []string{"INBOX", "UNREAD", "SENT", "DRAFT", "TRASH", "SPAM"}
+
+func NewFakeMailbox(email string) *FakeMailbox {
+	m := &FakeMailbox{
+		email:     email,
+		labels:    map[string]*gmail.Label{},
+		threads:   map[string][]*gmail.Message{},
+		drafts:    map[string]string{},
+		historyID: 1000,
+	}
+	for _, name := range systemLabels {
+		m.labels[name] = &gmail.Label{Id: name, Name: name, Type: "system"}
+	}
+	return m
+}
+
+func initFakeMailbox(account *Account, stateDir string) error {
+	if fakeStateStore == nil {
+		store, err := state.NewFileStore(filepath.Join(stateDir, "fake"))
+		if err != nil {
+			return err
+		}
+		fakeStateStore = store
+	}
+
+	account.fake = NewFakeMailbox(account.Email)
+	if account.FakeSeed == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(account.FakeSeed)
+	if err != nil {
+		return fmt.Errorf("gmail account %q: failed to read fake seed: %w", account.Name, err)
+	}
+
+	var seed FakeSeed
+	if err := json.Unmarshal(data, &seed); err != nil {
+		return fmt.Errorf("gmail account %q: failed to parse fake seed: %w", account.Name, err)
+	}
+
+	for _, name := range seed.Labels {
+		account.fake.AddLabel(name)
+	}
+	oldest := time.Now()
+	for _, thread := range seed.Threads {
+		account.fake.AddThread(thread.Labels, thread.Messages...)
+		for _, msg := range thread.Messages {
+			if !msg.Date.IsZero() && msg.Date.Before(oldest) {
+				oldest = msg.Date
+			}
+		}
+	}
+
+	// the mailbox starts over on every run, so the watches do too. Without a cursor they'd start
+	// from now and never report the seed, threads announced in an earlier run are skipped anyway.
+	for _, watch := range account.Watches {
+		if err := Rewind(account, watch.Name, oldest.Add(-time.Second)); err != nil {
+			return fmt.Errorf("gmail account %q: failed to rewind %q to the fake seed: %w", account.Name, watch.Name, err)
+		}
+	}
+
+	slog.Warn("Gmail account uses a fake mailbox", slog.String("account", account.Name), slog.Int("threads", len(seed.Threads)))
+	return nil
+}
+
+func fakeToken() *oauth2.Token {
+	return &oauth2.Token{AccessToken: "fake", Expiry: time.Now().Add(time.Hour)}
+}
+
+func (m *FakeMailbox) newID() string {
+	m.nextID++
+	return strconv.FormatInt(int64(0x1900000000000000+m.nextID), 16)
+}
+
+// AddLabel returns the ID of the user label, creating it if needed
+func (m *FakeMailbox) AddLabel(name string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.labelID(name)
+}
+
+func (m *FakeMailbox) labelID(name string) string {
+	for _, label := range m.labels {
+		if label.Name == name {
+			return label.Id
+		}
+	}
+
+	id := "Label_" + strconv.Itoa(len(m.labels)+1)
+	m.labels[id] = &gmail.Label{Id: id, Name: name, Type: "user"}
+	return id
+}
+
+// AddThread delivers a new unread inbox thread with the given labels and returns its ID
+func (m *FakeMailbox) AddThread(labelNames []string, messages ...FakeMessage) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labelIDs := []string{"INBOX", "UNREAD"}
+	for _, name := range labelNames {
+		labelIDs = append(labelIDs, m.labelID(name))
+	}
+
+	threadID := m.newID()
+	for _, msg := range messages {
+		m.deliver(threadID, msg, labelIDs)
+	}
+	return threadID
+}
+
+// AddReply delivers another message to an existing thread, with the labels the thread already has
+func (m *FakeMailbox) AddReply(threadID string, msg FakeMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, ok := m.threads[threadID]
+	if !ok {
+		return notFound("thread " + threadID)
+	}
+
+	labelIDs := []string{"UNREAD"}
+	for _, existing := range messages {
+		for _, id := range existing.LabelIds {
+			if !slices.Contains(labelIDs, id) && id != "SENT" {
+				labelIDs = append(labelIDs, id)
+			}
+		}
+	}
+
+	m.deliver(threadID, msg, labelIDs)
+	return nil
+}
+
+func (m *FakeMailbox) deliver(threadID string, msg FakeMessage, labelIDs []string) {
+	if msg.Date.IsZero() {
+		msg.Date = time.Now()
+	}
+	id := m.newID()
+
+	payload := &gmail.MessagePart{
+		MimeType: "multipart/alternative",
+		Headers: []*gmail.MessagePartHeader{
+			{Name: "From", Value: msg.From},
+			{Name: "To", Value: msg.To},
+			{Name: "Subject", Value: msg.Subject},
+			{Name: "Date", Value: msg.Date.Format(time.RFC1123Z)},
+			{Name: "Message-ID", Value: fmt.Sprintf("<%s@fake.mail>", id)},
+		},
+	}
+	for _, part := range []struct{ mimeType, body string }{{"text/plain", msg.Text}, {"text/html", msg.HTML}} {
+		if part.body != "" {
+			payload.Parts = append(payload.Parts, &gmail.MessagePart{
+				MimeType: part.mimeType,
+				Body:     &gmail.MessagePartBody{Data: base64.URLEncoding.EncodeToString([]byte(part.body)), Size: int64(len(part.body))},
+			})
+		}
+	}
+
+	snippet := []rune(msg.Text)
+	message := &gmail.Message{
+		Id:           id,
+		ThreadId:     threadID,
+		LabelIds:     slices.Clone(labelIDs),
+		Snippet:      string(snippet[:min(len(snippet), 100)]),
+		InternalDate: msg.Date.UnixMilli(),
+		Payload:      payload,
+	}
+	m.threads[threadID] = append(m.threads[threadID], message)
+
+	m.historyID++
+	m.history = append(m.history, &gmail.History{
+		Id:            m.historyID,
+		MessagesAdded: []*gmail.HistoryMessageAdded{{Message: m.summary(message)}},
+	})
+}
+
+// summary is the message as it appears in history records and minimal threads
+func (m *FakeMailbox) summary(msg *gmail.Message) *gmail.Message {
+	return &gmail.Message{Id: msg.Id, ThreadId: msg.ThreadId, LabelIds: slices.Clone(msg.LabelIds), Snippet: msg.Snippet}
+}
+
+func notFound(what string) error {
+	return &googleapi.Error{Code: http.StatusNotFound, Message: what + " not found"}
+}
+
+func (m *FakeMailbox) Profile(_ context.Context) (*gmail.Profile, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &gmail.Profile{EmailAddress: m.email, HistoryId: m.historyID, ThreadsTotal: int64(len(m.threads))}, nil
+}
+
+func (m *FakeMailbox) ListLabels(_ context.Context) ([]*gmail.Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]*gmail.Label, 0, len(m.labels))
+	for _, label := range m.labels {
+		copied := *label
+		labels = append(labels, &copied)
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Id < labels[j].Id })
+	return labels, nil
+}
+
+func (m *FakeMailbox) CreateLabel(ctx context.Context, label *gmail.Label) (*gmail.Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, existing := range m.labels {
+		if existing.Name == label.Name {
+			return nil, &googleapi.Error{Code: http.StatusConflict, Message: "label name exists or conflicts"}
+		}
+	}
+
+	id := m.labelID(label.Name)
+	logging.From(ctx).Info("Fake Gmail: created label", slog.String("label", label.Name))
+	copied := *m.labels[id]
+	return &copied, nil
+}
+
+func (m *FakeMailbox) ListThreads(_ context.Context, labelID, query string, limit int) ([]*gmail.Thread, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var after time.Time
+	for _, term := range strings.Fields(query) {
+		if value, ok := strings.CutPrefix(term, "after:"); ok {
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid query " + query}
+			}
+			after = time.Unix(seconds, 0)
+		}
+	}
+
+	var threads []*gmail.Thread
+	for id, messages := range m.threads {
+		var labeled, recent bool
+		for _, msg := range messages {
+			labeled = labeled || slices.Contains(msg.LabelIds, labelID)
+			recent = recent || time.UnixMilli(msg.InternalDate).After(after)
+		}
+		if labeled && recent {
+			threads = append(threads, &gmail.Thread{Id: id, Snippet: messages[len(messages)-1].Snippet})
+		}
+	}
+
+	sort.Slice(threads, func(i, j int) bool { return threads[i].Id > threads[j].Id }) // newest first
+	if limit > 0 && len(threads) > limit {
+		threads = threads[:limit]
+	}
+	return threads, nil
+}
+
+func (m *FakeMailbox) GetThread(_ context.Context, id, format string) (*gmail.Thread, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, ok := m.threads[id]
+	if !ok {
+		return nil, notFound("thread " + id)
+	}
+
+	thread := &gmail.Thread{Id: id, HistoryId: m.historyID}
+	for _, msg := range messages {
+		if format == "full" {
+			copied := *msg
+			copied.LabelIds = slices.Clone(msg.LabelIds)
+			thread.Messages = append(thread.Messages, &copied)
+		} else {
+			thread.Messages = append(thread.Messages, m.summary(msg))
+		}
+	}
+	return thread, nil
+}
+
+func (m *FakeMailbox) ModifyThread(ctx context.Context, id string, req *gmail.ModifyThreadRequest) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	messages, ok := m.threads[id]
+	if !ok {
+		return notFound("thread " + id)
+	}
+
+	for _, labelID := range req.AddLabelIds {
+		if _, ok := m.labels[labelID]; !ok {
+			return &googleapi.Error{Code: http.StatusBadRequest, Message: "invalid label " + labelID}
+		}
+	}
+
+	for _, msg := range messages {
+		var added []string
+		for _, labelID := range req.AddLabelIds {
+			if !slices.Contains(msg.LabelIds, labelID) {
+				msg.LabelIds = append(msg.LabelIds, labelID)
+				added = append(added, labelID)
+			}
+		}
+		msg.LabelIds = slices.DeleteFunc(msg.LabelIds, func(labelID string) bool {
+			return slices.Contains(req.RemoveLabelIds, labelID)
+		})
+
+		if len(added) > 0 {
+			m.historyID++
+			m.history = append(m.history, &gmail.History{
+				Id:          m.historyID,
+				LabelsAdded: []*gmail.HistoryLabelAdded{{Message: m.summary(msg), LabelIds: added}},
+			})
+		}
+	}
+
+	logging.From(ctx).Info("Fake Gmail: modified thread", slog.String("thread", id),
+		slog.Any("added", req.AddLabelIds), slog.Any("removed", req.RemoveLabelIds))
+	return nil
+}
+
+func (m *FakeMailbox) ListHistory(_ context.Context, labelID string, startID uint64) ([]*gmail.History, uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var records []*gmail.History
+	for _, record := range m.history {
+		if record.Id <= startID {
+			continue
+		}
+
+		var messages []*gmail.Message
+		for _, added := range record.MessagesAdded {
+			messages = append(messages, added.Message)
+		}
+		for _, added := range record.LabelsAdded {
+			messages = append(messages, added.Message)
+		}
+		if slices.ContainsFunc(messages, func(msg *gmail.Message) bool { return slices.Contains(msg.LabelIds, labelID) }) {
+			records = append(records, record)
+		}
+	}
+
+	return records, m.historyID, nil
+}
+
+// SendMessage files the message as sent in its thread, or a new one
+func (m *FakeMailbox) SendMessage(ctx context.Context, msg *gmail.Message) (*gmail.Message, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	threadID := msg.ThreadId
+	if _, ok := m.threads[threadID]; !ok {
+		threadID = m.newID()
+	}
+
+	sent := &gmail.Message{Id: m.newID(), ThreadId: threadID, LabelIds: []string{"SENT"}, Raw: msg.Raw, InternalDate: time.Now().UnixMilli()}
+	m.threads[threadID] = append(m.threads[threadID], sent)
+	m.historyID++
+	m.history = append(m.history, &gmail.History{
+		Id:            m.historyID,
+		MessagesAdded: []*gmail.HistoryMessageAdded{{Message: m.summary(sent)}},
+	})
+
+	logging.From(ctx).Info("Fake Gmail: sent message", slog.String("thread", threadID))
+	return m.summary(sent), nil
+}
+
+// CreateDraft files the draft in its thread, drafts don't show up in history
+func (m *FakeMailbox) CreateDraft(ctx context.Context, draft *gmail.Draft) (*gmail.Draft, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if draft.Message == nil {
+		return nil, &googleapi.Error{Code: http.StatusBadRequest, Message: "draft has no message"}
+	}
+
+	threadID := draft.Message.ThreadId
+	if _, ok := m.threads[threadID]; !ok {
+		threadID = m.newID()
+	}
+
+	msg := &gmail.Message{Id: m.newID(), ThreadId: threadID, LabelIds: []string{"DRAFT"}, Raw: draft.Message.Raw, InternalDate: time.Now().UnixMilli()}
+	m.threads[threadID] = append(m.threads[threadID], msg)
+
+	draftID := "r" + m.newID()
+	m.drafts[draftID] = msg.Id
+
+	logging.From(ctx).Info("Fake Gmail: created draft", slog.String("thread", threadID))
+	return &gmail.Draft{Id: draftID, Message: m.summary(msg)}, nil
+}
+
+// DeleteDraft removes the draft's message from its thread
+func (m *FakeMailbox) DeleteDraft(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msgID, ok := m.drafts[id]
+	if !ok {
+		return &googleapi.Error{Code: http.StatusNotFound, Message: "draft not found"}
+	}
+	delete(m.drafts, id)
+
+	for threadID, messages := range m.threads {
+		for i, msg := range messages {
+			if msg.Id == msgID {
+				m.threads[threadID] = append(messages[:i:i], messages[i+1:]...)
+				break
+			}
+		}
+	}
+
+	logging.From(ctx).Info("Fake Gmail: deleted draft", slog.String("draft", id))
+	return nil
+}
+
+func (m *FakeMailbox) Watch(_ context.Context, _ *gmail.WatchRequest) (*gmail.WatchResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &gmail.WatchResponse{HistoryId: m.historyID, Expiration: time.Now().Add(7 * 24 * time.Hour).UnixMilli()}, nil
+}
@@ -0,0 +1,151 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"my-api/admin"
+	"my-api/logging"
+	"my-api/slack"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	TokenOK             = "ok"
+	TokenReauthRequired = "reauth_required"
+	TokenError          = "error" // refresh failed for a reason that may go away, e.g. network
+	TokenUnknown        = "unknown"
+)
+
+type TokenHealth struct {
+	Status    string    `json:"status"`
+	CheckedAt time.Time `json:"checked_at,omitzero"`
+	Expiry    time.Time `json:"expiry,omitzero"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// re-send the re-auth alert at most this often while the token stays broken
+const reauthAlertInterval = 24 * time.Hour
+
+// needsReauth reports whether only a new consent (or delegation grant) can fix the error: no token
+// at all, or Google rejecting the refresh token (revoked, expired or password changed) or the
+// service account's delegation
+func needsReauth(err error) bool {
+	if errors.Is(err, ErrNoToken) {
+		return true
+	}
+
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) &&
+		(retrieveErr.ErrorCode == "invalid_grant" || retrieveErr.ErrorCode == "unauthorized_client")
+}
+
+// CheckTokenHealth forces a token refresh so a revoked refresh token is noticed
+// before a sync depends on it, and records the result
+func CheckTokenHealth(ctx context.Context, account *Account) TokenHealth {
+	refreshed, err := account.source.refresh(ctx, true)
+	if err != nil {
+		return account.TokenHealth() // already recorded by refresh
+	}
+
+	return recordTokenHealth(ctx, account, nil, refreshed.Expiry)
+}
+
+func recordTokenHealth(ctx context.Context, account *Account, err error, expiry time.Time) TokenHealth {
+	health := TokenHealth{Status: TokenOK, CheckedAt: time.Now().UTC(), Expiry: expiry}
+	if err != nil {
+		health.Status = TokenError
+		health.Error = err.Error()
+		if needsReauth(err) {
+			health.Status = TokenReauthRequired
+		}
+	}
+
+	account.healthMu.Lock()
+	account.health = health
+	alert := health.Status == TokenReauthRequired && time.Since(account.alertedAt) > reauthAlertInterval
+	if alert {
+		account.alertedAt = time.Now()
+	} else if health.Status == TokenOK {
+		account.alertedAt = time.Time{}
+	}
+	account.healthMu.Unlock()
+
+	if alert {
+		sendReauthAlert(ctx, account, health)
+	}
+	return health
+}
+
+// reauthLinkTTL is how long the one-time link in a re-auth alert works, the admin login works after that
+const reauthLinkTTL = 1 * time.Hour
+
+func sendReauthAlert(ctx context.Context, account *Account, health TokenHealth) {
+	var text string
+	if account.Auth == AuthServiceAccount {
+		text = fmt.Sprintf("*Gmail service account can't access the mailbox*\n"+
+			"Mailbox: %s\nReason: %s\n"+
+			"Label syncing is stopped until then. Check that the service account still has domain-wide "+
+			"delegation for the Gmail scopes in the Workspace admin console.",
+			account.Email, health.Error)
+	} else {
+		// with a setup code the link also works without ADMIN_PASSWORD
+		authURL := fmt.Sprintf("%s/auth?account=%s&setup_code=%s",
+			mainURL, url.QueryEscape(account.Name), url.QueryEscape(admin.NewSetupCode(reauthLinkTTL)))
+		text = fmt.Sprintf("*Gmail needs to be re-authorized*\n"+
+			"Mailbox: %s\nReason: %s\n"+
+			"Label syncing is stopped until then. <%s|Re-authorize> within an hour and sign in as %s, "+
+			"later the link needs the admin login.",
+			account.Email, health.Error, authURL, account.Email)
+	}
+
+	if err := slack.ScriptErrors.Send(ctx, *slack.NewMessage(text)); err != nil {
+		logging.From(ctx).Error("Failed to send Gmail re-auth alert", slog.Any("error", err))
+	}
+}
+
+// CheckToken returns an error unless the account has a token that is still valid or
+// can be refreshed right now. Unlike CheckTokenHealth it doesn't refresh a valid token.
+func CheckToken(ctx context.Context, account *Account) error {
+	_, err := account.source.refresh(ctx, false)
+	return err
+}
+
+// CheckStorage returns an error if the sync state can't be written
+func CheckStorage() error {
+	return stateStore.Check()
+}
+
+// TokenHealth returns the result of the account's last token check
+func (a *Account) TokenHealth() TokenHealth {
+	a.healthMu.Lock()
+	defer a.healthMu.Unlock()
+
+	if a.health.Status == "" {
+		return TokenHealth{Status: TokenUnknown}
+	}
+	return a.health
+}
+
+// TokenHealthHandler reports the last token check per account. Error details are only shown to admins.
+func TokenHealthHandler(ctx *gin.Context) {
+	status := 200
+	report := make(map[string]TokenHealth, len(accounts))
+	for _, account := range accounts {
+		health := account.TokenHealth()
+		if !admin.Authorized(ctx) {
+			health.Error = ""
+		}
+		if health.Status != TokenOK {
+			status = 503
+		}
+		report[account.Name] = health
+	}
+
+	ctx.JSON(status, gin.H{"accounts": report})
+}
@@ -1,12 +1,10 @@
 package gmail
 
 import (
-	"encoding/json"
 	"fmt"
 	"my-api/slack"
-	"net/url"
-	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"context"
@@ -14,58 +12,94 @@ import (
 	"google.golang.org/api/gmail/v1"
 )
 
-type LastChecked struct {
-	Timestamp time.Time `json:"timestamp"`
+// fetchMu serializes fetches so the polling job and push notifications don't report the same threads twice
+var fetchMu sync.Mutex
+
+const maxExcerptLength = 500
+
+func excerpt(text string) string {
+	runes := []rune(text)
+	if len(runes) <= maxExcerptLength {
+		return text
+	}
+	return strings.TrimSpace(string(runes[:maxExcerptLength])) + "…"
 }
 
-func slackSummary(threads []*gmail.Thread, permalink string) string {
-	var sb strings.Builder
-	sb.WriteString("*New FoodSpot requests*\n")
+// slackSummary lists new threads, with a link to the draft reply where drafts has one
+func slackSummary(account *Account, title string, threads []*FullThread, permalink string, extractor *Extractor, drafts map[string]*gmail.Draft) *slack.Payload {
+	payload := slack.NewMessage(fmt.Sprintf("*%s*", title))
 	for i, thread := range threads {
-		url := fmt.Sprintf("%s/%s", permalink, thread.Id)
-		sb.WriteString(fmt.Sprintf("<%s|View request %d>\n_%s_\n\n", url, i+1, thread.Snippet))
+		var sb strings.Builder
+		url := fmt.Sprintf("%s/%s", permalink, thread.ID)
+		subject := thread.Subject
+		if subject == "" {
+			subject = fmt.Sprintf("View request %d", i+1)
+		}
+		sb.WriteString(fmt.Sprintf("<%s|%s>\n", url, subject))
+
+		attachment := slack.Attachment{Color: "#2eb886"}
+		if msg := thread.Latest(); msg != nil {
+			writeMessage(&sb, msg)
+		}
+
+		if first := thread.First(); extractor != nil && first != nil {
+			extracted := extractor.Extract(first.Body)
+			for _, field := range extracted.Fields {
+				attachment.Fields = append(attachment.Fields, slack.Field{Title: field.Title, Value: field.Value, Short: true})
+			}
+			if len(extracted.Missing) > 0 {
+				attachment.Color = "#d9534f"
+				sb.WriteString(fmt.Sprintf(":warning: Missing: %s\n", strings.Join(extracted.Missing, ", ")))
+			}
+		}
+
+		if draft, ok := drafts[thread.ID]; ok {
+			sb.WriteString(fmt.Sprintf("<%s|Review draft reply>\n", draftLink(account, draft)))
+		}
+
+		attachment.Text = sb.String()
+		payload.Attach([]slack.Attachment{attachment})
 	}
 
-	return sb.String()
+	return payload
 }
 
-func saveLastChecked(t time.Time) error {
-	data, err := json.MarshalIndent(LastChecked{Timestamp: t}, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal last checked timestamp: %v", err)
-	}
-	if err := os.WriteFile("gmail/last_checked.json", data, 0600); err != nil {
-		return fmt.Errorf("failed to write last checked file: %s", err.Error())
+// replySummary reports a new message in a thread that was announced before
+func replySummary(thread *FullThread, msg *FullMessage, permalink string, announcement Announcement) *slack.Payload {
+	subject := announcement.Subject
+	if subject == "" {
+		subject = thread.Subject
 	}
 
-	return nil
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("<%s/%s|%s>\n", permalink, thread.ID, subject))
+	writeMessage(&sb, msg)
+
+	payload := slack.NewMessage(fmt.Sprintf("*New reply on request %s*", subject))
+	return payload.Attach([]slack.Attachment{{Color: "#439fe0", Text: sb.String()}})
 }
 
-// loadLastChecked loads the last checked timestamp from a file, returning a zero time if not found.
-func loadLastChecked() (time.Time, error) {
-	data, err := os.ReadFile("gmail/last_checked.json")
-	if err != nil {
-		if os.IsNotExist(err) {
-			return time.Now().UTC(), nil
-		}
-		return time.Now().UTC(), fmt.Errorf("unexpected failure to read last checked file. Returning current timestamp: %s", err.Error())
+func writeMessage(sb *strings.Builder, msg *FullMessage) {
+	sb.WriteString(fmt.Sprintf("From: %s\n", msg.Sender()))
+	if body := excerpt(msg.Body); body != "" {
+		sb.WriteString(fmt.Sprintf("```%s```\n", body))
 	}
-
-	var lastChecked LastChecked
-	if err := json.Unmarshal(data, &lastChecked); err != nil {
-		return time.Now().UTC(), fmt.Errorf("unexpected failure to parse last checked timestamp. Returning current timestamp: %s", err.Error())
+	if len(msg.Attachments) > 0 {
+		names := make([]string, 0, len(msg.Attachments))
+		for _, file := range msg.Attachments {
+			names = append(names, file.Filename)
+		}
+		sb.WriteString(fmt.Sprintf("Attachments: %s\n", strings.Join(names, ", ")))
 	}
-
-	return lastChecked.Timestamp, nil
 }
 
-func getLabelID(client *gmail.Service, labelName string) (string, error) {
-	labels, err := client.Users.Labels.List("me").Do()
+func getLabelID(ctx context.Context, client MailClient, labelName string) (string, error) {
+	labels, err := client.ListLabels(ctx)
 	if err != nil {
 		return "", fmt.Errorf("failed to get gmail labels: %w", err)
 	}
 
-	for _, label := range labels.Labels {
+	for _, label := range labels {
 		if label.Name == labelName {
 			return label.Id, nil
 		}
@@ -74,68 +108,113 @@ func getLabelID(client *gmail.Service, labelName string) (string, error) {
 	return "", fmt.Errorf("gmail label %q not found", labelName)
 }
 
-func GetThreadsByLabel(client *gmail.Service, labelName string) ([]*gmail.Thread, error) {
-	var threads []*gmail.Thread
+// SyncLabelWatch posts the threads that are new in the watched label to the watch's Slack channel.
+// Threads announced before are only reported again when someone replied, in the Slack thread
+// of the announcement if the channel supports threads.
+func SyncLabelWatch(ctx context.Context, account *Account, watch LabelWatch) error {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
 
-	labelID, err := getLabelID(client, labelName)
+	channel, err := watch.slackChannel()
 	if err != nil {
-		return threads, fmt.Errorf("returning empty thread list: %s", err.Error())
+		return err
 	}
 
-	lastChecked, err := loadLastChecked()
+	client, err := account.mailClient(ctx)
 	if err != nil {
-		return threads, err
+		return err
 	}
 
-	query := fmt.Sprintf("to:me after:%d", lastChecked.Unix())
-	pageToken := ""
-
-	for {
-		req := client.Users.Threads.List("me").LabelIds(labelID).Q(query).MaxResults(500)
-		if pageToken != "" {
-			req.PageToken(pageToken)
-		}
-
-		response, err := req.Do()
-		if err != nil {
-			return threads, fmt.Errorf("failed to request gmail threads: %w", err)
-		}
+	announced, err := loadAnnounced(account)
+	if err != nil {
+		reportStateError(ctx, err)
+		return err
+	}
 
-		threads = append(threads, response.Threads...)
-		if pageToken == "" {
-			break
-		}
-		pageToken = response.NextPageToken
+	threads, next, err := GetThreadsForWatch(ctx, client, account, watch)
+	if err != nil {
+		return fmt.Errorf("failed to list threads: %s", err.Error())
 	}
 
-	if err := saveLastChecked(time.Now().UTC()); err != nil {
-		return threads, err
+	if len(threads) == 0 {
+		return commitCursor(ctx, account, watch, next)
 	}
 
-	return threads, nil
-}
+	threadIDs := make([]string, 0, len(threads))
+	for _, thread := range threads {
+		threadIDs = append(threadIDs, thread.Id)
+	}
 
-// TestListThreads lists and prints threads with label foodspot-requests
-func GetNewThreadsByLabel(ctx context.Context, labelName string) error {
-	service, err := getGmailService(ctx)
+	fullThreads, err := GetFullThreads(ctx, client, threadIDs)
 	if err != nil {
 		return err
 	}
 
-	threads, err := GetThreadsByLabel(service, labelName)
-	if err != nil {
-		return fmt.Errorf("failed to list threads: %s", err.Error())
+	var fresh []*FullThread
+	var handled []string
+	permalink := account.permalink(watch.Label)
+	now := time.Now().UTC()
+
+	for _, thread := range fullThreads {
+		last := thread.lastIncoming(account.Email)
+		if last == nil {
+			continue
+		}
+
+		announcement, ok := announced.get(watch.Name, thread.ID)
+		if !ok {
+			fresh = append(fresh, thread)
+			continue
+		}
+		if announcement.LastMessageID == last.ID {
+			continue // listed again without anything new
+		}
+
+		payload := replySummary(thread, last, permalink, announcement)
+		payload.ThreadTS = announcement.SlackTS
+		if _, err := channel.Post(ctx, *payload); err != nil {
+			return err
+		}
+
+		announcement.LastMessageID, announcement.UpdatedAt = last.ID, now
+		announced.set(watch.Name, thread.ID, announcement)
+		if err := saveAnnounced(account, announced); err != nil {
+			reportStateError(ctx, err)
+			return err
+		}
+		handled = append(handled, thread.ID)
 	}
 
-	if len(threads) == 0 {
-		return nil
+	if len(fresh) > 0 {
+		drafts := createDraftReplies(ctx, client, account, watch, fresh)
+		payload := slackSummary(account, watch.Title, fresh, permalink, ExtractorFor(watch.Label), drafts)
+		ts, err := channel.Post(ctx, *payload)
+		if err != nil {
+			deleteDrafts(ctx, client, drafts)
+			return err
+		}
+
+		for _, thread := range fresh {
+			announced.set(watch.Name, thread.ID, Announcement{
+				Subject:       thread.Subject,
+				LastMessageID: thread.lastIncoming(account.Email).ID,
+				SlackTS:       ts,
+				AnnouncedAt:   now,
+				UpdatedAt:     now,
+			})
+			handled = append(handled, thread.ID)
+		}
+		if err := saveAnnounced(account, announced); err != nil {
+			reportStateError(ctx, err)
+			return err
+		}
 	}
 
-	permalink := fmt.Sprintf("https://mail.google.com/mail/u/%s/#label/%s",
-		url.PathEscape(emailUser), url.PathEscape(labelName),
-	)
+	// only now that every thread is announced, otherwise the next sync lists them again
+	if err := commitCursor(ctx, account, watch, next); err != nil {
+		return err
+	}
+	sendAcknowledgements(ctx, account, watch, fresh)
 
-	slackText := slackSummary(threads, permalink)
-	payload := slack.NewMessage(slackText)
-	return slack.Internal.Send(ctx, *payload)
+	return applyThreadActions(ctx, client, account, watch, handled)
 }
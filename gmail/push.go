@@ -0,0 +1,322 @@
+package gmail
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"my-api/config"
+	"my-api/logging"
+	"my-api/metrics"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/idtoken"
+)
+
+// pushConfig holds the Pub/Sub settings. Push is disabled when topic is empty.
+type pushConfig struct {
+	topic          string // projects/<project>/topics/<topic>
+	audience       string // expected "aud" claim of the push JWT
+	serviceAccount string // expected "email" claim of the push JWT
+	token          string // shared token passed as ?token= on the push URL
+}
+
+type pushMessage struct {
+	Message struct {
+		Data        string `json:"data"`
+		MessageID   string `json:"messageId"`
+		PublishTime string `json:"publishTime"`
+	} `json:"message"`
+	Subscription string `json:"subscription"`
+}
+
+type pushNotification struct {
+	EmailAddress string `json:"emailAddress"`
+	HistoryID    uint64 `json:"historyId"`
+}
+
+var (
+	push   pushConfig
+	syncer labelSyncer
+)
+
+func initPushConfig(cfg config.Gmail) {
+	push = pushConfig{
+		topic:          cfg.PubSubTopic,
+		audience:       cfg.PushAudience,
+		serviceAccount: cfg.PushServiceAccount,
+		token:          cfg.PushToken,
+	}
+
+	if PushEnabled() {
+		metrics.RegisterQueue("gmail_push_fetches", syncer.pending)
+	}
+}
+
+// PushEnabled reports whether Gmail push notifications are configured
+func PushEnabled() bool {
+	return push.topic != ""
+}
+
+// Watch (re)registers the account's Gmail watch for the labels of its label watches.
+// Gmail expires a watch after 7 days.
+func Watch(ctx context.Context, account *Account) error {
+	if !PushEnabled() || len(account.Watches) == 0 {
+		return nil
+	}
+
+	client, err := account.mailClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	labelNames := account.watchedLabels()
+	labelIDs := make([]string, 0, len(labelNames))
+	for _, name := range labelNames {
+		id, err := getLabelID(ctx, client, name)
+		if err != nil {
+			return err
+		}
+		labelIDs = append(labelIDs, id)
+	}
+
+	res, err := client.Watch(ctx, &gmail.WatchRequest{
+		TopicName:           push.topic,
+		LabelIds:            labelIDs,
+		LabelFilterBehavior: "include",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to register gmail watch: %w", err)
+	}
+
+	account.watchMu.Lock()
+	account.watchExpiration = time.UnixMilli(res.Expiration).UTC()
+	account.watchMu.Unlock()
+
+	logging.From(ctx).Info("Registered Gmail watch",
+		slog.String("account", account.Name),
+		slog.Any("labels", labelNames),
+		slog.Time("expiration", time.UnixMilli(res.Expiration).UTC()))
+	return nil
+}
+
+// WatchExpiration returns when the account's watch stops delivering notifications (zero if never registered)
+func (a *Account) WatchExpiration() time.Time {
+	a.watchMu.Lock()
+	defer a.watchMu.Unlock()
+	return a.watchExpiration
+}
+
+func verifyPush(ctx *gin.Context) error {
+	if push.token != "" {
+		if subtle.ConstantTimeCompare([]byte(ctx.Query("token")), []byte(push.token)) == 1 {
+			return nil
+		}
+		if push.serviceAccount == "" {
+			return fmt.Errorf("invalid push token")
+		}
+	}
+
+	bearer, ok := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if !ok || bearer == "" {
+		return fmt.Errorf("missing bearer token")
+	}
+
+	payload, err := idtoken.Validate(ctx.Request.Context(), bearer, push.audience)
+	if err != nil {
+		return fmt.Errorf("invalid push JWT: %w", err)
+	}
+
+	email, _ := payload.Claims["email"].(string)
+	verified, _ := payload.Claims["email_verified"].(bool)
+	if email != push.serviceAccount || !verified {
+		return fmt.Errorf("unexpected push JWT email %q", email)
+	}
+
+	return nil
+}
+
+// PushHandler receives Pub/Sub push messages for the Gmail watch and triggers an incremental fetch.
+// Any 2xx response acks the message, so invalid notifications are acked too to stop redelivery.
+func PushHandler(ctx *gin.Context) {
+	if !PushEnabled() {
+		ctx.JSON(404, gin.H{"error": "Gmail push is not enabled"})
+		return
+	}
+
+	if err := verifyPush(ctx); err != nil {
+		logging.From(ctx).Warn("Rejected Gmail push notification", slog.Any("error", err))
+		ctx.JSON(401, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	var msg pushMessage
+	if err := ctx.ShouldBindJSON(&msg); err != nil {
+		logging.From(ctx).Warn("Unexpected Gmail push body", slog.Any("error", err))
+		ctx.Status(204)
+		return
+	}
+
+	data, err := base64.StdEncoding.DecodeString(msg.Message.Data)
+	if err != nil {
+		logging.From(ctx).Warn("Failed to decode Gmail push data", slog.Any("error", err))
+		ctx.Status(204)
+		return
+	}
+
+	var notification pushNotification
+	if err := json.Unmarshal(data, &notification); err != nil {
+		logging.From(ctx).Warn("Failed to parse Gmail push data", slog.Any("error", err))
+		ctx.Status(204)
+		return
+	}
+
+	account := accountByEmail(notification.EmailAddress)
+	if account == nil {
+		logging.From(ctx).Warn("Ignoring Gmail push for unknown mailbox", slog.String("email", notification.EmailAddress))
+		ctx.Status(204)
+		return
+	}
+
+	logging.From(ctx).Debug("Gmail push received",
+		slog.String("account", account.Name),
+		slog.String("message_id", msg.Message.MessageID),
+		slog.Uint64("history_id", notification.HistoryID))
+
+	for _, watch := range account.Watches {
+		syncer.trigger(ctx.Request.Context(), account, watch) // not ctx, gin reuses it after the handler returns
+	}
+
+	ctx.Status(204)
+}
+
+// labelSyncer makes sure only one fetch per watch runs at a time. A trigger that arrives
+// during a fetch schedules exactly one more run once it finishes.
+type labelSyncer struct {
+	mu      sync.Mutex
+	running map[string]bool
+	again   map[string]bool
+	origins map[string]context.Context // latest trigger, its request ID and logger carry into the next run
+	stopped bool
+	wg      sync.WaitGroup
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (s *labelSyncer) trigger(from context.Context, account *Account, watch LabelWatch) {
+	name := account.Name + "/" + watch.Name
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return
+	}
+	if s.running == nil {
+		s.running, s.again, s.origins = map[string]bool{}, map[string]bool{}, map[string]context.Context{}
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	s.origins[name] = from
+	if s.running[name] {
+		s.again[name] = true
+		s.mu.Unlock()
+		return
+	}
+	s.running[name] = true
+	s.wg.Add(1)
+	s.mu.Unlock()
+
+	go func() {
+		defer s.wg.Done()
+		for {
+			s.mu.Lock()
+			origin := s.origins[name]
+			s.mu.Unlock()
+
+			ctx, cancel := context.WithTimeout(s.ctx, 1*time.Minute)
+			ctx = logging.Carry(ctx, origin)
+			if logging.RequestID(ctx) == "" {
+				ctx = logging.WithRequestID(ctx, logging.NewRequestID())
+			}
+			ctx = logging.With(ctx, slog.String("watch", name))
+			if err := SyncLabelWatch(ctx, account, watch); err != nil {
+				logging.From(ctx).Warn(fmt.Sprintf("Gmail push fetch for %q failed: %s", name, err.Error()))
+			}
+			cancel()
+
+			s.mu.Lock()
+			if !s.again[name] || s.stopped {
+				s.running[name] = false
+				s.mu.Unlock()
+				return
+			}
+			s.again[name] = false
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// pending counts the fetches that are running or scheduled to run again
+func (s *labelSyncer) pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for name, running := range s.running {
+		if running {
+			count++
+		}
+		if s.again[name] {
+			count++
+		}
+	}
+	return count
+}
+
+// stop ignores further triggers and waits for running fetches. Fetches still running
+// when ctx expires are cancelled.
+func (s *labelSyncer) stop(ctx context.Context) error {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var running []string
+	for name, ok := range s.running {
+		if ok {
+			running = append(running, name)
+		}
+	}
+	if len(running) == 0 {
+		return nil
+	}
+
+	s.cancel()
+	slices.Sort(running)
+	return fmt.Errorf("cancelled unfinished push fetches: %s", strings.Join(running, ", "))
+}
+
+// StopPushSyncs waits for the fetches triggered by push notifications until ctx expires
+func StopPushSyncs(ctx context.Context) error {
+	return syncer.stop(ctx)
+}
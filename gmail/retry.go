@@ -0,0 +1,154 @@
+package gmail
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"my-api/logging"
+	"my-api/metrics"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	maxAttempts      = 5
+	baseBackoff      = 500 * time.Millisecond
+	maxBackoff       = 30 * time.Second
+	maxConcurrentGet = 5 // concurrent Threads.Get calls per sync, Gmail allows about 250 quota units/s per user
+)
+
+// retryable reports whether Gmail asked to slow down or failed on its side
+func retryable(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	if apiErr.Code == http.StatusTooManyRequests || apiErr.Code >= 500 {
+		return true
+	}
+	if apiErr.Code == http.StatusForbidden {
+		for _, item := range apiErr.Errors {
+			if item.Reason == "rateLimitExceeded" || item.Reason == "userRateLimitExceeded" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// backoff is the wait before the given retry: Retry-After if Gmail sent one,
+// otherwise exponential with full jitter
+func backoff(err error, retry int) time.Duration {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && apiErr.Header != nil {
+		if seconds, convErr := strconv.Atoi(apiErr.Header.Get("Retry-After")); convErr == nil && seconds > 0 {
+			return min(time.Duration(seconds)*time.Second, maxBackoff)
+		}
+	}
+
+	limit := min(baseBackoff<<retry, maxBackoff)
+	return time.Duration(rand.Int64N(int64(limit))) + baseBackoff/2
+}
+
+// observeCall counts a Gmail request and its error in the metrics, by HTTP status if Gmail answered
+func observeCall(op string, err error) {
+	code := ""
+	if err != nil {
+		code = "network"
+		var apiErr *googleapi.Error
+		if errors.As(err, &apiErr) {
+			code = strconv.Itoa(apiErr.Code)
+		}
+	}
+	metrics.GmailCall(op, code)
+}
+
+// withRetry runs a Gmail call, retrying rate limits and server errors. It gives up early
+// when the context would expire before the next attempt.
+func withRetry[T any](ctx context.Context, op string, call func() (T, error)) (T, error) {
+	for retry := 0; ; retry++ {
+		result, err := call()
+		observeCall(op, err)
+		if err == nil || !retryable(err) || retry+1 >= maxAttempts {
+			return result, err
+		}
+
+		wait := backoff(err, retry)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			return result, fmt.Errorf("%s: giving up before the deadline: %w", op, err)
+		}
+
+		logging.From(ctx).Warn("Gmail request failed, retrying",
+			slog.String("op", op), slog.Int("attempt", retry+1), slog.Duration("wait", wait), slog.Any("error", err))
+
+		select {
+		case <-ctx.Done():
+			return result, fmt.Errorf("%s: %w", op, errors.Join(ctx.Err(), err))
+		case <-time.After(wait):
+		}
+	}
+}
+
+// getThreads fetches the threads with at most maxConcurrentGet requests in flight. Threads
+// that no longer exist are left out when skipMissing is set, the order of ids is kept.
+func getThreads(ctx context.Context, client MailClient, ids []string, format string, skipMissing bool) ([]*gmail.Thread, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]*gmail.Thread, len(ids))
+	sem := make(chan struct{}, maxConcurrentGet)
+	var wg sync.WaitGroup
+
+	// the first failure cancels the rest, whose errors are just "canceled"
+	var failOnce sync.Once
+	var firstErr error
+	fail := func(err error) {
+		failOnce.Do(func() { firstErr = err })
+		cancel()
+	}
+
+loop:
+	for i, id := range ids {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			thread, err := client.GetThread(ctx, id, format)
+			if err != nil && !(skipMissing && isNotFound(err)) {
+				fail(fmt.Errorf("failed to get gmail thread %s: %w", id, err))
+				return
+			}
+			results[i] = thread
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	threads := make([]*gmail.Thread, 0, len(ids))
+	for _, thread := range results {
+		if thread != nil {
+			threads = append(threads, thread)
+		}
+	}
+	return threads, nil
+}
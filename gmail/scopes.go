@@ -0,0 +1,133 @@
+package gmail
+
+import (
+	"errors"
+	"fmt"
+	"my-api/state"
+	"net/url"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+)
+
+// scopeNames are the short names accepted in ?scope= and an account's "scopes"
+var scopeNames = map[string]string{
+	"readonly": gmail.GmailReadonlyScope,
+	"send":     gmail.GmailSendScope,
+	"modify":   gmail.GmailModifyScope,
+	"compose":  gmail.GmailComposeScope,
+}
+
+// ScopeError means the account hasn't granted a scope a feature needs
+type ScopeError struct {
+	Account *Account
+	Scope   string
+}
+
+func (e *ScopeError) Error() string {
+	if e.Account.Auth == AuthServiceAccount {
+		return fmt.Sprintf("gmail account %q: add %s to its scopes and to the domain-wide delegation", e.Account.Name, e.Scope)
+	}
+	return fmt.Sprintf("gmail account %q hasn't granted %s, authorize it at %s", e.Account.Name, e.Scope, e.Account.consentURL(e.Scope))
+}
+
+// resolveScopes maps scope names to Gmail scope URLs, always including the read-only scope
+func resolveScopes(names []string) ([]string, error) {
+	scopes := []string{gmail.GmailReadonlyScope}
+	for _, name := range names {
+		scope, ok := scopeNames[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown gmail scope %q", name)
+		}
+		if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+// grantedScopes is persisted per mailbox since stored tokens don't keep the scope of the token response
+type grantedScopes struct {
+	Scopes []string `json:"scopes"`
+}
+
+func scopesKey(account *Account) string {
+	return "gmail-scopes-" + account.Email
+}
+
+// loadGrantedScopes reads the scopes of the last consent. Tokens from before scopes were tracked
+// only ever had the read-only scope.
+func (a *Account) loadGrantedScopes() error {
+	var granted grantedScopes
+	err := stateStore.Get(scopesKey(a), &granted)
+	if errors.Is(err, state.ErrNotFound) {
+		granted.Scopes = []string{gmail.GmailReadonlyScope}
+	} else if err != nil {
+		return err
+	}
+
+	a.scopesMu.Lock()
+	a.granted = granted.Scopes
+	a.scopesMu.Unlock()
+	return nil
+}
+
+// recordGrantedScopes stores the scopes Google reports for a freshly exchanged token
+func (a *Account) recordGrantedScopes(token *oauth2.Token) error {
+	raw, _ := token.Extra("scope").(string)
+	if raw == "" {
+		return nil
+	}
+
+	scopes := strings.Fields(raw)
+	if err := stateStore.Put(scopesKey(a), grantedScopes{Scopes: scopes}); err != nil {
+		return err
+	}
+
+	a.scopesMu.Lock()
+	a.granted = scopes
+	a.scopesMu.Unlock()
+	return nil
+}
+
+// requireScope returns a *ScopeError unless the account may use scope, or one of the
+// broader alternatives that also allow the call
+func (a *Account) requireScope(scope string, alternatives ...string) error {
+	if a.Auth == AuthFake {
+		return nil
+	}
+
+	granted := a.delegationScopes()
+	if a.Auth == AuthOAuth {
+		a.scopesMu.Lock()
+		granted = slices.Clone(a.granted)
+		a.scopesMu.Unlock()
+	}
+
+	for _, s := range append([]string{scope}, alternatives...) {
+		if slices.Contains(granted, s) {
+			return nil
+		}
+	}
+	return &ScopeError{Account: a, Scope: scope}
+}
+
+func (a *Account) delegationScopes() []string {
+	if a.delegation == nil {
+		return nil
+	}
+	return a.delegation.Scopes
+}
+
+// consentURL links to /auth asking for the scope on top of those already granted
+func (a *Account) consentURL(scope string) string {
+	query := url.Values{"account": {a.Name}}
+	for name, s := range scopeNames {
+		if s == scope {
+			query.Set("scope", name)
+		}
+	}
+	return fmt.Sprintf("%s/auth?%s", mainURL, query.Encode())
+}
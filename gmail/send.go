@@ -0,0 +1,262 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"my-api/logging"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+)
+
+// Email is an outgoing message. Text and HTML are sent as multipart/alternative,
+// ThreadID and the reply headers keep a reply in the original conversation.
+type Email struct {
+	To         []string // addresses, e.g. "Jane Doe <jane@example.com>"
+	Cc         []string
+	Subject    string
+	Text       string
+	HTML       string
+	ThreadID   string // Gmail thread ID
+	InReplyTo  string // Message-ID of the message replied to
+	References []string
+}
+
+// Reply prepares an email answering the latest message of the thread that wasn't sent from mailbox
+func Reply(thread *FullThread, mailbox string) (*Email, error) {
+	latest := thread.lastIncoming(mailbox)
+	if latest == nil || latest.From == nil {
+		return nil, fmt.Errorf("thread %s has no message to reply to", thread.ID)
+	}
+
+	subject := thread.Subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+
+	email := &Email{
+		To:        []string{latest.From.String()},
+		Subject:   subject,
+		ThreadID:  thread.ID,
+		InReplyTo: latest.MessageID,
+	}
+	email.References = strings.Fields(latest.References)
+	if latest.MessageID != "" {
+		email.References = append(email.References, latest.MessageID)
+	}
+
+	return email, nil
+}
+
+// Send delivers the email from the account's mailbox. Needs the "send" scope, see OAuthHandler.
+func Send(ctx context.Context, account *Account, email *Email) (*gmail.Message, error) {
+	if err := account.requireScope(gmail.GmailSendScope); err != nil {
+		return nil, err
+	}
+
+	raw, err := BuildMIME(&mail.Address{Address: account.Email}, email)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := account.mailClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &gmail.Message{Raw: base64.URLEncoding.EncodeToString(raw), ThreadId: email.ThreadID}
+	sent, err := client.SendMessage(ctx, message)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send email %q: %w", email.Subject, err)
+	}
+
+	return sent, nil
+}
+
+// sendAcknowledgements answers each new thread with the watch's Acknowledge template.
+// Failures are only logged, the threads are announced already and won't be acknowledged twice.
+func sendAcknowledgements(ctx context.Context, account *Account, watch LabelWatch, threads []*FullThread) {
+	if watch.Acknowledge == "" {
+		return
+	}
+
+	for _, thread := range threads {
+		if thread.lastIncoming(account.Email) == nil {
+			continue // only our own messages, nobody to acknowledge
+		}
+		if err := sendAcknowledgement(ctx, account, watch, thread); err != nil {
+			logging.From(ctx).Error("Failed to acknowledge a request", slog.String("watch", watch.Name), slog.String("thread", thread.ID), slog.Any("error", err))
+			if _, ok := err.(*ScopeError); ok {
+				return // same for every thread
+			}
+		}
+	}
+}
+
+func sendAcknowledgement(ctx context.Context, account *Account, watch LabelWatch, thread *FullThread) error {
+	reply, err := Reply(thread, account.Email)
+	if err != nil {
+		return err
+	}
+
+	rendered, err := RenderEmail(watch.Acknowledge, draftData(watch, thread))
+	if err != nil {
+		return err
+	}
+	reply.Text, reply.HTML = rendered.Text, rendered.HTML
+
+	_, err = Send(ctx, account, reply)
+	return err
+}
+
+// OrderConfirmation is what the order_confirmation template gets
+type OrderConfirmation struct {
+	Name    string
+	OrderID string
+	Total   string
+}
+
+// CheckOrderConfirmation returns the account order confirmations are sent from, after rendering
+// the template once so a broken one fails at startup
+func CheckOrderConfirmation(accountName string) (*Account, error) {
+	account, err := AccountByName(accountName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := RenderEmail("order_confirmation", OrderConfirmation{}); err != nil {
+		return nil, err
+	}
+	if err := account.requireScope(gmail.GmailSendScope); err != nil {
+		slog.Warn("Order confirmations won't be sent", slog.Any("error", err))
+	}
+	return account, nil
+}
+
+// SendOrderConfirmation emails the order_confirmation template to the customer
+func SendOrderConfirmation(ctx context.Context, account *Account, to string, order OrderConfirmation) error {
+	if err := account.requireScope(gmail.GmailSendScope); err != nil {
+		return err
+	}
+
+	email, err := RenderEmail("order_confirmation", order)
+	if err != nil {
+		return err
+	}
+	email.To = []string{to}
+
+	_, err = Send(ctx, account, email)
+	return err
+}
+
+// BuildMIME renders the email as an RFC 5322 message
+func BuildMIME(from *mail.Address, email *Email) ([]byte, error) {
+	if len(email.To) == 0 {
+		return nil, fmt.Errorf("email %q has no recipients", email.Subject)
+	}
+	if email.Text == "" && email.HTML == "" {
+		return nil, fmt.Errorf("email %q has no body", email.Subject)
+	}
+
+	to, err := formatAddresses(email.To)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := formatAddresses(email.Cc)
+	if err != nil {
+		return nil, err
+	}
+
+	headers := []struct{ name, value string }{
+		{"From", from.String()},
+		{"To", to},
+		{"Cc", cc},
+		{"Subject", mime.QEncoding.Encode("utf-8", email.Subject)},
+		{"Date", time.Now().Format(time.RFC1123Z)},
+		{"Message-ID", newMessageID(from.Address)},
+		{"In-Reply-To", email.InReplyTo},
+		{"References", strings.Join(email.References, " ")},
+		{"MIME-Version", "1.0"},
+	}
+
+	var buf bytes.Buffer
+	for _, header := range headers {
+		if header.value == "" {
+			continue
+		}
+		if strings.ContainsAny(header.value, "\r\n") {
+			return nil, fmt.Errorf("email header %s contains a line break", header.name)
+		}
+		fmt.Fprintf(&buf, "%s: %s\r\n", header.name, header.value)
+	}
+
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", email.Text},
+		{"text/html; charset=utf-8", email.HTML},
+	}
+
+	writer := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/alternative; boundary=%q\r\n\r\n", writer.Boundary())
+
+	// the preferred (richer) part goes last
+	for _, part := range parts {
+		if part.body == "" {
+			continue
+		}
+
+		w, err := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func formatAddresses(addresses []string) (string, error) {
+	formatted := make([]string, 0, len(addresses))
+	for _, address := range addresses {
+		parsed, err := mail.ParseAddress(address)
+		if err != nil {
+			return "", fmt.Errorf("invalid email address %q: %w", address, err)
+		}
+		formatted = append(formatted, parsed.String())
+	}
+	return strings.Join(formatted, ", "), nil
+}
+
+func newMessageID(from string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(from, "@"); at >= 0 {
+		domain = from[at+1:]
+	}
+
+	random := make([]byte, 16)
+	rand.Read(random)
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(random), domain)
+}
@@ -0,0 +1,58 @@
+package gmail
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	AuthOAuth          = "oauth"           // user consent through /auth, token kept in the token store
+	AuthServiceAccount = "service_account" // service account key with domain-wide delegation
+)
+
+// initServiceAccount loads the account's service account key. The key's client ID must be granted
+// the Gmail scopes under domain-wide delegation in the Workspace admin console.
+func initServiceAccount(account *Account) error {
+	if account.ServiceAccountKey == "" {
+		return fmt.Errorf("gmail account %q: service_account auth needs a service account key file", account.Name)
+	}
+
+	data, err := os.ReadFile(account.ServiceAccountKey)
+	if err != nil {
+		return fmt.Errorf("gmail account %q: failed to read service account key: %w", account.Name, err)
+	}
+
+	scopes, err := resolveScopes(account.Scopes)
+	if err != nil {
+		return fmt.Errorf("gmail account %q: %w", account.Name, err)
+	}
+
+	jwtConfig, err := google.JWTConfigFromJSON(data, scopes...)
+	if err != nil {
+		return fmt.Errorf("gmail account %q: invalid service account key: %w", account.Name, err)
+	}
+	jwtConfig.Subject = account.Email // impersonate the mailbox
+
+	account.delegation = jwtConfig
+	return nil
+}
+
+// impersonate returns an access token for the mailbox signed by the service account.
+// There's nothing to persist, a new one can always be minted from the key.
+func (s *persistingTokenSource) impersonate(ctx context.Context, force bool) (*oauth2.Token, error) {
+	if s.token.Valid() && !force {
+		return s.token, nil
+	}
+
+	token, err := s.account.delegation.TokenSource(ctx).Token()
+	if err != nil {
+		return nil, fmt.Errorf("failed to impersonate %s with the service account: %w", s.account.Email, err)
+	}
+
+	s.token = token
+	return token, nil
+}
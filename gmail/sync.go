@@ -0,0 +1,344 @@
+package gmail
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"my-api/logging"
+	"my-api/slack"
+	"my-api/state"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// Cursor is the sync position of a label watch. Timestamp is only used as a hint for a full resync
+// when Gmail no longer has the history starting at HistoryID.
+type Cursor struct {
+	HistoryID uint64    `json:"history_id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// cursorState holds the cursors of one account, keyed by label watch name
+type cursorState struct {
+	Cursors map[string]Cursor `json:"cursors"`
+}
+
+// legacyLastChecked is the old gmail/last_checked.json, only read to seed the cursors the first time
+type legacyLastChecked struct {
+	Timestamp time.Time `json:"timestamp"`
+}
+
+const legacyLastCheckedPath = "gmail/last_checked.json"
+
+var stateStore state.Store
+
+// stateDir is STATE_DIR, for state that isn't kept in stateStore like the default token files
+var stateDir string
+
+// fakeStateStore keeps the cursors and announcements of fake mailboxes apart, under STATE_DIR/fake
+var fakeStateStore state.Store
+
+func (a *Account) store() state.Store {
+	if a.fake != nil {
+		return fakeStateStore
+	}
+	return stateStore
+}
+
+func cursorKey(account string) string {
+	return "gmail-cursors-" + account
+}
+
+// loadCursors returns the account's cursors. A missing state is fine (syncing starts from now),
+// a corrupted one is returned as *state.CorruptError so the caller can stop and report it.
+func loadCursors(account *Account) (cursorState, error) {
+	var cursors cursorState
+	err := account.store().Get(cursorKey(account.Email), &cursors)
+	if errors.Is(err, state.ErrNotFound) {
+		return loadLegacyCursors(account)
+	}
+	if err != nil {
+		return cursorState{}, err
+	}
+
+	if cursors.Cursors == nil {
+		cursors.Cursors = map[string]Cursor{}
+	}
+	return cursors, nil
+}
+
+// loadLegacyCursors seeds the default account from the old gmail/last_checked.json
+func loadLegacyCursors(account *Account) (cursorState, error) {
+	cursors := cursorState{Cursors: map[string]Cursor{}}
+	if account.Name != DefaultAccount || account.fake != nil {
+		return cursors, nil
+	}
+
+	data, err := os.ReadFile(legacyLastCheckedPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cursors, nil
+		}
+		return cursors, fmt.Errorf("failed to read %s: %w", legacyLastCheckedPath, err)
+	}
+
+	var legacy legacyLastChecked
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return cursors, &state.CorruptError{Key: "legacy last checked", Path: legacyLastCheckedPath, Err: err}
+	}
+
+	for _, watch := range account.Watches {
+		cursors.Cursors[watch.Name] = Cursor{Timestamp: legacy.Timestamp}
+	}
+
+	return cursors, nil
+}
+
+func loadCursor(account *Account, name string) (Cursor, error) {
+	cursors, err := loadCursors(account)
+	if err != nil {
+		return Cursor{}, err
+	}
+
+	return cursors.Cursors[name], nil
+}
+
+func saveCursor(account *Account, name string, cursor Cursor) error {
+	cursors, err := loadCursors(account)
+	if err != nil {
+		return err
+	}
+
+	cursors.Cursors[name] = cursor
+	if err := account.store().Put(cursorKey(account.Email), cursors); err != nil {
+		return fmt.Errorf("failed to save gmail cursor for %q: %w", name, err)
+	}
+
+	return nil
+}
+
+// Rewind makes the next sync of the watch report every thread in the label since the given time
+func Rewind(account *Account, watchName string, since time.Time) error {
+	return saveCursor(account, watchName, Cursor{Timestamp: since.UTC()})
+}
+
+// re-send the corrupted state alert for the same file at most this often, every sync runs into it
+const stateAlertInterval = 24 * time.Hour
+
+var (
+	stateAlertMu   sync.Mutex
+	stateAlertedAt = map[string]time.Time{} // by file path
+)
+
+// reportStateError alerts ScriptErrors when stored state is corrupted, since syncing stays
+// paused until someone fixes or removes the file
+func reportStateError(ctx context.Context, err error) {
+	var corrupt *state.CorruptError
+	if !errors.As(err, &corrupt) {
+		return
+	}
+
+	stateAlertMu.Lock()
+	alert := time.Since(stateAlertedAt[corrupt.Path]) > stateAlertInterval
+	if alert {
+		stateAlertedAt[corrupt.Path] = time.Now()
+	}
+	stateAlertMu.Unlock()
+	if !alert {
+		logging.From(ctx).Warn("Gmail sync state is still corrupted", slog.String("path", corrupt.Path), slog.Any("error", corrupt.Err))
+		return
+	}
+
+	text := fmt.Sprintf("*Gmail sync state is corrupted*\nFile: `%s`\nError: %s\n"+
+		"Label syncing is paused. Fix the file, or delete it to restart syncing from now.",
+		corrupt.Path, corrupt.Err.Error())
+	if sendErr := slack.ScriptErrors.Send(ctx, *slack.NewMessage(text)); sendErr != nil {
+		logging.From(ctx).Error("Failed to report corrupted Gmail sync state", slog.Any("error", sendErr))
+	}
+}
+
+func isNotFound(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound
+}
+
+// reportable filters out our own outgoing mail, mirroring the old "to:me" query
+func reportable(msg *gmail.Message, labelID string) bool {
+	if msg == nil || msg.ThreadId == "" {
+		return false
+	}
+	if slices.Contains(msg.LabelIds, "SENT") || slices.Contains(msg.LabelIds, "DRAFT") {
+		return false
+	}
+	return len(msg.LabelIds) == 0 || slices.Contains(msg.LabelIds, labelID)
+}
+
+// listHistory returns the threads that received a message or got the label since startID,
+// together with the history ID to continue from next time.
+func listHistory(ctx context.Context, client MailClient, labelID string, startID uint64) ([]string, uint64, error) {
+	var threadIDs []string
+	seen := map[string]bool{}
+
+	records, latest, err := client.ListHistory(ctx, labelID, startID)
+	if err != nil {
+		return nil, startID, err
+	}
+
+	for _, history := range records {
+		var messages []*gmail.Message
+		for _, added := range history.MessagesAdded {
+			messages = append(messages, added.Message)
+		}
+		for _, added := range history.LabelsAdded {
+			if slices.Contains(added.LabelIds, labelID) {
+				messages = append(messages, added.Message)
+			}
+		}
+
+		for _, msg := range messages {
+			if reportable(msg, labelID) && !seen[msg.ThreadId] {
+				seen[msg.ThreadId] = true
+				threadIDs = append(threadIDs, msg.ThreadId)
+			}
+		}
+	}
+
+	return threadIDs, latest, nil
+}
+
+// resyncLabel lists the label by date when there is no usable history ID. The cursor is taken
+// from the profile before listing, so mail arriving meanwhile is picked up by the next sync.
+// Without any previous checkpoint nothing is reported and syncing starts from now.
+func resyncLabel(ctx context.Context, client MailClient, labelID, query string, since time.Time) ([]*gmail.Thread, uint64, error) {
+	profile, err := client.Profile(ctx)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get gmail profile: %w", err)
+	}
+
+	if since.IsZero() {
+		return nil, profile.HistoryId, nil
+	}
+
+	query = strings.TrimSpace(fmt.Sprintf("%s after:%d", query, since.Unix()))
+	threads, err := client.ListThreads(ctx, labelID, query, 0)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to request gmail threads: %w", err)
+	}
+
+	return threads, profile.HistoryId, nil
+}
+
+// matchingThreads keeps the thread IDs that match the watch's search query. History records
+// can't be searched, so the label is listed with the query over the time the cursor covers.
+func matchingThreads(ctx context.Context, client MailClient, labelID, query string, since time.Time, threadIDs []string) ([]string, error) {
+	if query == "" || len(threadIDs) == 0 {
+		return threadIDs, nil
+	}
+
+	if !since.IsZero() {
+		// after: only has day precision in practice, so look back a bit further
+		query = fmt.Sprintf("%s after:%d", query, since.Add(-24*time.Hour).Unix())
+	}
+
+	listed, err := client.ListThreads(ctx, labelID, query, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request gmail threads: %w", err)
+	}
+
+	matches := map[string]bool{}
+	for _, thread := range listed {
+		matches[thread.Id] = true
+	}
+
+	var filtered []string
+	for _, id := range threadIDs {
+		if matches[id] {
+			filtered = append(filtered, id)
+		}
+	}
+	return filtered, nil
+}
+
+// getThreadSummaries fetches the minimal thread for each ID, filling in the snippet of its latest message
+func getThreadSummaries(ctx context.Context, client MailClient, threadIDs []string) ([]*gmail.Thread, error) {
+	// threads deleted since the history record was written are skipped
+	threads, err := getThreads(ctx, client, threadIDs, "minimal", true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, thread := range threads {
+		if n := len(thread.Messages); n > 0 && thread.Snippet == "" {
+			thread.Snippet = thread.Messages[n-1].Snippet
+		}
+	}
+
+	return threads, nil
+}
+
+// GetThreadsForWatch returns the threads that are new in the watched label since the last sync,
+// together with the cursor to continue from. The caller saves it with commitCursor only once the
+// threads are handled, so a failure in between lists them again on the next sync.
+func GetThreadsForWatch(ctx context.Context, client MailClient, account *Account, watch LabelWatch) ([]*gmail.Thread, Cursor, error) {
+	var threads []*gmail.Thread
+
+	labelID, err := getLabelID(ctx, client, watch.Label)
+	if err != nil {
+		return threads, Cursor{}, fmt.Errorf("returning empty thread list: %s", err.Error())
+	}
+
+	cursor, err := loadCursor(account, watch.Name)
+	if err != nil {
+		reportStateError(ctx, err)
+		return threads, Cursor{}, err
+	}
+
+	startedAt := time.Now().UTC()
+	var next uint64
+
+	if cursor.HistoryID != 0 {
+		var threadIDs []string
+		threadIDs, next, err = listHistory(ctx, client, labelID, cursor.HistoryID)
+		if err == nil {
+			if threadIDs, err = matchingThreads(ctx, client, labelID, watch.Query, cursor.Timestamp, threadIDs); err != nil {
+				return threads, Cursor{}, err
+			}
+			threads, err = getThreadSummaries(ctx, client, threadIDs)
+			if err != nil {
+				return threads, Cursor{}, err
+			}
+		} else if isNotFound(err) { // start history ID is too old, Gmail keeps roughly a week
+			logging.From(ctx).Warn(fmt.Sprintf("Gmail history for %q expired, running a full resync", watch.Name))
+			cursor.HistoryID = 0
+		} else {
+			return threads, Cursor{}, fmt.Errorf("failed to list gmail history: %w", err)
+		}
+	}
+
+	if cursor.HistoryID == 0 {
+		threads, next, err = resyncLabel(ctx, client, labelID, watch.Query, cursor.Timestamp)
+		if err != nil {
+			return threads, Cursor{}, err
+		}
+	}
+
+	return threads, Cursor{HistoryID: next, Timestamp: startedAt}, nil
+}
+
+// commitCursor saves the cursor returned by GetThreadsForWatch once its threads are handled
+func commitCursor(ctx context.Context, account *Account, watch LabelWatch, cursor Cursor) error {
+	if err := saveCursor(account, watch.Name, cursor); err != nil {
+		reportStateError(ctx, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package gmail
+
+import (
+	"bytes"
+	"embed"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"strings"
+	texttemplate "text/template"
+)
+
+//go:embed templates
+var embeddedTemplates embed.FS
+
+// templatesDir is G_MAIL_TEMPLATES, so wording can change without a rebuild
+var templatesDir string
+
+func emailTemplates() fs.FS {
+	if templatesDir != "" {
+		return os.DirFS(templatesDir)
+	}
+	sub, _ := fs.Sub(embeddedTemplates, "templates")
+	return sub
+}
+
+// RenderEmail fills the template <name>.txt.tmpl, which defines "subject" unless it's only used
+// for replies, and the optional <name>.html.tmpl. The recipients and thread are left for the caller.
+func RenderEmail(name string, data any) (*Email, error) {
+	return renderEmail(name, data, "missingkey=default")
+}
+
+// renderEmail executes the templates with a text/template missingkey option, "missingkey=error" to check templates
+func renderEmail(name string, data any, missingKey string) (*Email, error) {
+	templates := emailTemplates()
+
+	text, err := texttemplate.New(name+".txt.tmpl").Option(missingKey).ParseFS(templates, name+".txt.tmpl")
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email template %q: %w", name, err)
+	}
+
+	var subject, body bytes.Buffer
+	if text.Lookup("subject") != nil {
+		if err := text.ExecuteTemplate(&subject, "subject", data); err != nil {
+			return nil, fmt.Errorf("failed to render subject of %q: %w", name, err)
+		}
+	}
+	if err := text.Execute(&body, data); err != nil {
+		return nil, fmt.Errorf("failed to render email %q: %w", name, err)
+	}
+
+	email := &Email{Subject: strings.TrimSpace(subject.String()), Text: body.String()}
+
+	html, err := htmltemplate.New(name+".html.tmpl").Option(missingKey).ParseFS(templates, name+".html.tmpl")
+	if errors.Is(err, fs.ErrNotExist) {
+		return email, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load email template %q: %w", name, err)
+	}
+
+	var htmlBody bytes.Buffer
+	if err := html.Execute(&htmlBody, data); err != nil {
+		return nil, fmt.Errorf("failed to render email %q: %w", name, err)
+	}
+	email.HTML = htmlBody.String()
+
+	return email, nil
+}
@@ -0,0 +1,313 @@
+package gmail
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding/htmlindex"
+	"google.golang.org/api/gmail/v1"
+)
+
+// FullThread is a Gmail thread with every message decoded
+type FullThread struct {
+	ID       string
+	Subject  string
+	Messages []FullMessage
+}
+
+type FullMessage struct {
+	ID          string
+	From        *mail.Address
+	To          []*mail.Address
+	Subject     string
+	Date        time.Time
+	Body        string // text/plain if present, otherwise the HTML part stripped to text
+	Attachments []AttachmentMeta
+	MessageID   string // RFC 5322 Message-ID header
+	References  string
+	LabelIDs    []string
+}
+
+type AttachmentMeta struct {
+	ID       string
+	Filename string
+	MimeType string
+	Size     int64
+}
+
+// First returns the message that started the thread
+func (t *FullThread) First() *FullMessage {
+	if len(t.Messages) == 0 {
+		return nil
+	}
+	return &t.Messages[0]
+}
+
+// Latest returns the most recent message in the thread
+func (t *FullThread) Latest() *FullMessage {
+	if len(t.Messages) == 0 {
+		return nil
+	}
+	return &t.Messages[len(t.Messages)-1]
+}
+
+// Sender formats the From address as "Name <email>", or just the email if there's no name
+func (m *FullMessage) Sender() string {
+	if m.From == nil {
+		return ""
+	}
+	if m.From.Name == "" {
+		return m.From.Address
+	}
+	return fmt.Sprintf("%s <%s>", m.From.Name, m.From.Address)
+}
+
+var headerDecoder = &mime.WordDecoder{CharsetReader: charsetReader}
+
+func charsetReader(charset string, input io.Reader) (io.Reader, error) {
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q: %w", charset, err)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// GetFullThread fetches a thread with its full message payloads and decodes them
+func GetFullThread(ctx context.Context, client MailClient, threadID string) (*FullThread, error) {
+	thread, err := client.GetThread(ctx, threadID, "full")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gmail thread %s: %w", threadID, err)
+	}
+
+	return decodeThread(thread)
+}
+
+// GetFullThreads fetches and decodes several threads concurrently, keeping their order
+func GetFullThreads(ctx context.Context, client MailClient, threadIDs []string) ([]*FullThread, error) {
+	threads, err := getThreads(ctx, client, threadIDs, "full", false)
+	if err != nil {
+		return nil, err
+	}
+
+	full := make([]*FullThread, 0, len(threads))
+	for _, thread := range threads {
+		decoded, err := decodeThread(thread)
+		if err != nil {
+			return nil, err
+		}
+		full = append(full, decoded)
+	}
+	return full, nil
+}
+
+func decodeThread(thread *gmail.Thread) (*FullThread, error) {
+	full := &FullThread{ID: thread.Id}
+	for _, msg := range thread.Messages {
+		decoded, err := decodeMessage(msg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode gmail message %s: %w", msg.Id, err)
+		}
+		full.Messages = append(full.Messages, *decoded)
+	}
+
+	if first := full.First(); first != nil {
+		full.Subject = first.Subject
+	}
+
+	return full, nil
+}
+
+func decodeMessage(msg *gmail.Message) (*FullMessage, error) {
+	decoded := &FullMessage{ID: msg.Id, LabelIDs: msg.LabelIds}
+	if msg.Payload == nil {
+		return decoded, nil
+	}
+
+	for _, header := range msg.Payload.Headers {
+		value := decodeHeader(header.Value)
+		switch strings.ToLower(header.Name) {
+		case "from":
+			decoded.From = parseAddress(value)
+		case "to":
+			decoded.To = parseAddressList(value)
+		case "subject":
+			decoded.Subject = value
+		case "date":
+			if date, err := mail.ParseDate(value); err == nil {
+				decoded.Date = date.UTC()
+			}
+		case "message-id":
+			decoded.MessageID = value
+		case "references":
+			decoded.References = value
+		}
+	}
+
+	if decoded.Date.IsZero() && msg.InternalDate != 0 {
+		decoded.Date = time.UnixMilli(msg.InternalDate).UTC()
+	}
+
+	var plain, htmlBody string
+	var walk func(part *gmail.MessagePart) error
+	walk = func(part *gmail.MessagePart) error {
+		if part.Filename != "" && part.Body != nil {
+			decoded.Attachments = append(decoded.Attachments, AttachmentMeta{
+				ID:       part.Body.AttachmentId,
+				Filename: part.Filename,
+				MimeType: part.MimeType,
+				Size:     part.Body.Size,
+			})
+			return nil
+		}
+
+		mediaType := strings.ToLower(part.MimeType)
+		if (mediaType == "text/plain" && plain == "") || (mediaType == "text/html" && htmlBody == "") {
+			text, err := decodeBody(part)
+			if err != nil {
+				return err
+			}
+			if mediaType == "text/plain" {
+				plain = text
+			} else {
+				htmlBody = text
+			}
+		}
+
+		for _, child := range part.Parts {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(msg.Payload); err != nil {
+		return nil, err
+	}
+
+	if strings.TrimSpace(plain) != "" {
+		decoded.Body = normalizeText(plain)
+	} else {
+		decoded.Body = normalizeText(htmlToText(htmlBody))
+	}
+
+	return decoded, nil
+}
+
+func decodeHeader(value string) string {
+	decoded, err := headerDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
+
+func parseAddress(value string) *mail.Address {
+	address, err := mail.ParseAddress(value)
+	if err != nil {
+		return &mail.Address{Address: strings.TrimSpace(value)}
+	}
+	return address
+}
+
+func parseAddressList(value string) []*mail.Address {
+	addresses, err := mail.ParseAddressList(value)
+	if err != nil {
+		return []*mail.Address{{Address: strings.TrimSpace(value)}}
+	}
+	return addresses
+}
+
+// decodeBody returns the part body as UTF-8. Gmail already undoes the transfer encoding,
+// but the bytes are still in the charset named by the part's Content-Type.
+func decodeBody(part *gmail.MessagePart) (string, error) {
+	if part.Body == nil || part.Body.Data == "" {
+		return "", nil
+	}
+
+	data, err := base64.URLEncoding.DecodeString(part.Body.Data)
+	if err != nil {
+		if data, err = base64.RawURLEncoding.DecodeString(part.Body.Data); err != nil {
+			return "", fmt.Errorf("failed to decode part body: %w", err)
+		}
+	}
+
+	charset := "utf-8"
+	for _, header := range part.Headers {
+		if strings.EqualFold(header.Name, "Content-Type") {
+			if _, params, err := mime.ParseMediaType(header.Value); err == nil && params["charset"] != "" {
+				charset = params["charset"]
+			}
+		}
+	}
+
+	if strings.EqualFold(charset, "utf-8") || strings.EqualFold(charset, "us-ascii") {
+		return string(data), nil
+	}
+
+	reader, err := charsetReader(charset, bytes.NewReader(data))
+	if err != nil {
+		return string(data), nil // better to show mojibake than nothing
+	}
+
+	text, err := io.ReadAll(reader)
+	if err != nil {
+		return "", fmt.Errorf("failed to convert %s body: %w", charset, err)
+	}
+	return string(text), nil
+}
+
+// htmlToText keeps the visible text of an HTML body, turning block elements into line breaks
+func htmlToText(body string) string {
+	var sb strings.Builder
+	tokenizer := html.NewTokenizer(strings.NewReader(body))
+	skip := 0
+
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return sb.String()
+		case html.TextToken:
+			if skip == 0 {
+				sb.Write(tokenizer.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip++
+			case "br", "p", "div", "tr", "li", "h1", "h2", "h3", "h4", "table":
+				sb.WriteString("\n")
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			switch string(name) {
+			case "script", "style", "head":
+				skip = max(skip-1, 0)
+			case "p", "div", "tr", "li", "h1", "h2", "h3", "h4", "table":
+				sb.WriteString("\n")
+			}
+		}
+	}
+}
+
+var (
+	trailingSpace = regexp.MustCompile(`[ \t\r]+\n`)
+	blankLines    = regexp.MustCompile(`\n{3,}`)
+)
+
+func normalizeText(text string) string {
+	text = strings.ReplaceAll(text, " ", " ")
+	text = trailingSpace.ReplaceAllString(text, "\n")
+	text = blankLines.ReplaceAllString(text, "\n\n")
+	return strings.TrimSpace(text)
+}
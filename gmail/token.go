@@ -2,64 +2,140 @@ package gmail
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"os"
+	"log/slog"
+	"my-api/logging"
+	"net/http"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
 )
 
 type Token struct {
 	*oauth2.Token
 }
 
-func (t *Token) Refresh(ctx context.Context) error {
-	if t.AccessToken != "" && t.Expiry.Before(time.Now()) {
-		newToken, err := config.TokenSource(ctx, t.Token).Token()
+func (t *Token) Save(ctx context.Context, account *Account) error {
+	if err := account.tokens.Save(ctx, t.Token); err != nil {
+		return fmt.Errorf("token.Save() failed: %s", err.Error())
+	}
+
+	return nil
+}
+
+// persistingTokenSource hands out the current access token of an account and refreshes it when
+// it expires. Every refreshed token is written back to the account's token store, so a restart
+// never starts from a stale token. It's shared by all Gmail callers and safe for concurrent use.
+type persistingTokenSource struct {
+	account *Account
+
+	mu    sync.Mutex
+	token *oauth2.Token
+}
+
+// tokenRefreshTimeout bounds a refresh for callers without a context, since every Gmail call waits on s.mu meanwhile
+const tokenRefreshTimeout = 30 * time.Second
+
+// Token implements oauth2.TokenSource for the HTTP transport of the shared Gmail client
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tokenRefreshTimeout)
+	defer cancel()
+	return s.refresh(ctx, false)
+}
+
+// refresh returns a valid token, refreshing it if expired or if force is set.
+// Failures are recorded in the token health, outside the lock since that may alert Slack.
+func (s *persistingTokenSource) refresh(ctx context.Context, force bool) (*oauth2.Token, error) {
+	token, err := s.refreshLocked(ctx, force)
+	if err != nil {
+		recordTokenHealth(ctx, s.account, err, time.Time{})
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *persistingTokenSource) refreshLocked(ctx context.Context, force bool) (*oauth2.Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.account.Auth {
+	case AuthServiceAccount:
+		return s.impersonate(ctx, force)
+	case AuthFake:
+		return fakeToken(), nil
+	}
+
+	if s.token == nil {
+		token, err := s.account.tokens.Load(ctx)
 		if err != nil {
-			return fmt.Errorf("token.Refresh() failed to refresh token: %s", err.Error())
+			return nil, fmt.Errorf("failed to load token: %w", err)
 		}
+		s.token = token
+	}
 
-		if newToken.AccessToken != t.AccessToken {
-			t.Token = newToken
-			if err := t.Save(); err != nil {
-				return fmt.Errorf("token.Refresh() failed to save refreshed token: %s", err.Error())
-			}
-		}
+	if s.token.Valid() && !force {
+		return s.token, nil
 	}
 
-	return nil
-}
+	current := *s.token
+	if force {
+		current.Expiry = time.Now().Add(-time.Minute)
+	}
 
-func (t *Token) Save() error {
-	data, err := json.MarshalIndent(t.Token, "", "  ")
+	// oauthConfig.TokenSource only uses ctx for the refresh request itself
+	refreshed, err := oauthConfig.TokenSource(ctx, &current).Token()
 	if err != nil {
-		return fmt.Errorf("token.Save() failed to marshal token data: %s", err.Error())
+		return nil, fmt.Errorf("failed to refresh token: %w", err)
 	}
 
-	if err := os.WriteFile("gmail/token.json", data, 0600); err != nil {
-		return fmt.Errorf("token.Save() failed to write to gmail/token.json: %s", err.Error())
+	if refreshed.AccessToken != s.token.AccessToken {
+		saveCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 10*time.Second)
+		defer cancel()
+
+		if err := s.account.tokens.Save(saveCtx, refreshed); err != nil {
+			// keep using the new token, the next refresh will try saving again
+			logging.From(ctx).Error("Failed to persist refreshed Gmail token", slog.String("account", s.account.Name), slog.Any("error", err))
+		}
 	}
 
-	return nil
+	s.token = refreshed
+	return refreshed, nil
 }
 
-func loadToken(ctx context.Context) (*Token, error) {
-	data, err := os.ReadFile("gmail/token.json")
-	if err != nil {
-		return nil, fmt.Errorf("loadToken() failed to read gmail/token.json: %s", err.Error())
+// replace swaps in a token from a new consent
+func (s *persistingTokenSource) replace(token *oauth2.Token) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// mailClient returns the account's Gmail client shared by jobs and push handlers. The token is
+// checked up front so a missing or revoked token fails fast instead of on the first API call.
+func (a *Account) mailClient(ctx context.Context) (MailClient, error) {
+	if a.Auth == AuthFake {
+		return a.fake, nil
 	}
 
-	var token oauth2.Token
-	if err := json.Unmarshal(data, &token); err != nil {
-		return nil, fmt.Errorf("loadToken() failed to unmarshal token data: %s", err.Error())
+	a.serviceOnce.Do(func() {
+		// the client outlives any single request or job, so it must not use their contexts.
+		// oauth2.NewClient would wrap the source in a ReuseTokenSource that keeps serving the old
+		// token after a new consent, the source already caches the token itself
+		client := &http.Client{Transport: &oauth2.Transport{Source: a.source, Base: &logging.Transport{}}}
+		a.service, a.serviceErr = gmail.NewService(context.Background(), option.WithHTTPClient(client))
+		if a.serviceErr != nil {
+			a.serviceErr = fmt.Errorf("failed to create Gmail service: %w", a.serviceErr)
+		}
+	})
+	if a.serviceErr != nil {
+		return nil, a.serviceErr
 	}
 
-	t := &Token{Token: &token}
-	if err := t.Refresh(ctx); err != nil {
-		return nil, fmt.Errorf("loadToken() failed to call token.Refresh(): %s", err.Error())
+	if _, err := a.source.refresh(ctx, false); err != nil {
+		return nil, err
 	}
 
-	return t, nil
+	return &serviceClient{service: a.service}, nil
 }
@@ -0,0 +1,321 @@
+package gmail
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"my-api/config"
+	"my-api/state"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+	_ "modernc.org/sqlite"
+)
+
+var ErrNoToken = errors.New("no oauth token stored")
+
+// TokenStore persists the OAuth token of one Gmail account
+type TokenStore interface {
+	// Load returns ErrNoToken if nothing has been stored yet
+	Load(ctx context.Context) (*oauth2.Token, error)
+	Save(ctx context.Context, token *oauth2.Token) error
+}
+
+// TokenStoreConfig selects the token store, see NewTokenStore
+type TokenStoreConfig struct {
+	Kind    string // "file" (default), "encrypted" or "sqlite"
+	Path    string // token file, or database file for sqlite
+	Key     string // base64 AES-256 key for "encrypted"
+	Account string // account name, picks the default file name and the sqlite row
+	Dir     string // STATE_DIR, where the default files go
+}
+
+// tokenStoreConfig picks the account's store from TOKEN_STORE, TOKEN_PATH and TOKEN_KEY.
+// TOKEN_PATH only applies to the default account, others use their token_path or a file named after them.
+func tokenStoreConfig(store config.TokenStore, account *Account, stateDir string) TokenStoreConfig {
+	cfg := TokenStoreConfig{
+		Kind:    store.Kind,
+		Path:    account.TokenPath,
+		Key:     store.Key,
+		Account: account.Name,
+		Dir:     stateDir,
+	}
+
+	if cfg.Path == "" && (cfg.Kind == "sqlite" || account.Name == DefaultAccount) {
+		cfg.Path = store.Path
+	}
+
+	return cfg
+}
+
+func NewTokenStore(cfg TokenStoreConfig) (TokenStore, error) {
+	suffix := ""
+	if cfg.Account != "" && cfg.Account != DefaultAccount {
+		suffix = "-" + cfg.Account
+	}
+
+	switch cfg.Kind {
+	case "", "file":
+		if cfg.Path != "" {
+			return &FileTokenStore{Path: cfg.Path}, nil
+		}
+		path := defaultFilePath(cfg.Dir, suffix)
+		return &FileTokenStore{Path: path, InPlace: path == legacyTokenPath}, nil
+	case "encrypted":
+		key, err := base64.StdEncoding.DecodeString(cfg.Key)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encrypted token store needs a base64 encoded 32 byte TOKEN_KEY or TOKEN_KEY_FILE")
+		}
+		return &EncryptedTokenStore{Path: withDefault(cfg.Path, filepath.Join(cfg.Dir, "token"+suffix+".enc")), key: key}, nil
+	case "sqlite":
+		return NewSQLiteTokenStore(withDefault(cfg.Path, filepath.Join(cfg.Dir, "mangopost.db")), cfg.Account)
+	default:
+		return nil, fmt.Errorf("unknown TOKEN_STORE %q", cfg.Kind)
+	}
+}
+
+// legacyTokenPath is where the token lived before the token stores, still used by older deployments
+const legacyTokenPath = "gmail/token.json"
+
+// defaultFilePath keeps reading gmail/token.json for the default account until it has been migrated to STATE_DIR
+func defaultFilePath(dir, suffix string) string {
+	path := filepath.Join(dir, "token"+suffix+".json")
+	if suffix != "" {
+		return path
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return path
+	}
+	if _, err := os.Stat(legacyTokenPath); err != nil {
+		return path
+	}
+	slog.Warn("Using the legacy token file, run migrate-token to move it", slog.String("path", legacyTokenPath))
+	return legacyTokenPath
+}
+
+func withDefault(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// FileTokenStore keeps the token as plain JSON, like the original gmail/token.json
+type FileTokenStore struct {
+	Path string
+
+	// InPlace overwrites the file instead of renaming a temp file over it, which fails with EBUSY
+	// on a single-file bind mount like the legacy gmail/token.json in docker-compose
+	InPlace bool
+}
+
+func (s *FileTokenStore) Load(_ context.Context) (*oauth2.Token, error) {
+	data, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoToken
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", s.Path, err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token data in %s: %w", s.Path, err)
+	}
+
+	return &token, nil
+}
+
+func (s *FileTokenStore) Save(_ context.Context, token *oauth2.Token) error {
+	data, err := json.MarshalIndent(token, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal token data: %w", err)
+	}
+
+	if s.InPlace {
+		if err := os.WriteFile(s.Path, data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", s.Path, err)
+		}
+		return nil
+	}
+	return state.WriteFileAtomic(s.Path, data, 0600)
+}
+
+// EncryptedTokenStore keeps the token JSON sealed with AES-256-GCM, stored as base64(nonce || ciphertext)
+type EncryptedTokenStore struct {
+	Path string
+	key  []byte
+}
+
+// tokenAAD binds the ciphertext to its purpose so it can't be swapped with other data sealed by the same key
+var tokenAAD = []byte("mangopost-oauth-token")
+
+func (s *EncryptedTokenStore) gcm() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *EncryptedTokenStore) Load(_ context.Context) (*oauth2.Token, error) {
+	encoded, err := os.ReadFile(s.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoToken
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", s.Path, err)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", s.Path, err)
+	}
+
+	gcm, err := s.gcm()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("encrypted token in %s is truncated", s.Path)
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	data, err := gcm.Open(nil, nonce, ciphertext, tokenAAD)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s, wrong TOKEN_KEY?: %w", s.Path, err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token data in %s: %w", s.Path, err)
+	}
+
+	return &token, nil
+}
+
+func (s *EncryptedTokenStore) Save(_ context.Context, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token data: %w", err)
+	}
+
+	gcm, err := s.gcm()
+	if err != nil {
+		return err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := gcm.Seal(nonce, nonce, data, tokenAAD)
+	encoded := base64.StdEncoding.EncodeToString(sealed)
+	return state.WriteFileAtomic(s.Path, []byte(encoded), 0600)
+}
+
+// SQLiteTokenStore keeps tokens in the oauth_tokens table, one row per account
+type SQLiteTokenStore struct {
+	db      *sql.DB
+	account string
+}
+
+func NewSQLiteTokenStore(path, account string) (*SQLiteTokenStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open token database %s: %w", path, err)
+	}
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS oauth_tokens (
+		account    TEXT PRIMARY KEY,
+		token      TEXT NOT NULL,
+		updated_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create oauth_tokens table: %w", err)
+	}
+
+	return &SQLiteTokenStore{db: db, account: account}, nil
+}
+
+func (s *SQLiteTokenStore) Load(ctx context.Context) (*oauth2.Token, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, `SELECT token FROM oauth_tokens WHERE account = ?`, s.account).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoToken
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query token for %s: %w", s.account, err)
+	}
+
+	var token oauth2.Token
+	if err := json.Unmarshal([]byte(data), &token); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token data for %s: %w", s.account, err)
+	}
+
+	return &token, nil
+}
+
+func (s *SQLiteTokenStore) Save(ctx context.Context, token *oauth2.Token) error {
+	data, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token data: %w", err)
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO oauth_tokens (account, token, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(account) DO UPDATE SET token = excluded.token, updated_at = excluded.updated_at`,
+		s.account, string(data), time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return fmt.Errorf("failed to save token for %s: %w", s.account, err)
+	}
+
+	return nil
+}
+
+// MigrateToken copies a plain token.json into the account's configured store and verifies it reads back
+func MigrateToken(ctx context.Context, accountName, from string) error {
+	account, err := AccountByName(accountName)
+	if err != nil {
+		return err
+	}
+	if account.tokens == nil {
+		return fmt.Errorf("gmail account %q uses %s auth and has no token store", account.Name, account.Auth)
+	}
+
+	// the default file store falls back to the legacy file, migrate that one into STATE_DIR
+	if store, ok := account.tokens.(*FileTokenStore); ok && store.Path == from && from == legacyTokenPath {
+		account.tokens = &FileTokenStore{Path: filepath.Join(stateDir, "token.json")}
+	}
+
+	source := &FileTokenStore{Path: from}
+	token, err := source.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", from, err)
+	}
+
+	if err := account.tokens.Save(ctx, token); err != nil {
+		return fmt.Errorf("failed to save token to the configured store: %w", err)
+	}
+
+	saved, err := account.tokens.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read back migrated token: %w", err)
+	}
+	if saved.RefreshToken != token.RefreshToken {
+		return fmt.Errorf("migrated token doesn't match %s", from)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package gmail
+
+import (
+	"encoding/json"
+	"fmt"
+	"my-api/slack"
+	"os"
+
+	"github.com/robfig/cron/v3"
+)
+
+// LabelWatch reports new threads in a Gmail label to a Slack channel on a schedule.
+// Name identifies the job and its sync cursor, so it must stay stable once in use.
+type LabelWatch struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Query    string `json:"query,omitempty"` // extra Gmail search terms, e.g. "to:me"
+	Schedule string `json:"schedule"`        // cron with seconds
+	Channel  string `json:"channel"`         // Slack channel name, e.g. "internal-notifications"
+	Title    string `json:"title"`
+
+	// Webhook or ChannelID (posting with SLACK_BOT_TOKEN) send to a channel that isn't configured
+	// globally, Channel then only names it
+	Webhook   string `json:"webhook,omitempty"`
+	ChannelID string `json:"channel_id,omitempty"`
+
+	Actions ThreadActions `json:"actions,omitzero"` // run on the threads after they're posted
+	Draft   string        `json:"draft,omitempty"`  // email template for a draft reply to new threads, see DraftData
+
+	// Acknowledge is an email template sent right away as reply to new threads, see DraftData
+	Acknowledge string `json:"acknowledge,omitempty"`
+}
+
+// scheduleParser reads schedules like the job manager's cron, with seconds
+var scheduleParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// defaultWatches is used unless G_LABEL_WATCHES points to a JSON file with a list of watches
+var defaultWatches = []LabelWatch{
+	{
+		Name:     "FoodSpotThreadsJob",
+		Label:    "Mangopost/FoodSpot Requests",
+		Query:    "to:me",
+		Schedule: "0 0 */2 * * *",
+		Channel:  "internal-notifications",
+		Title:    "New FoodSpot requests",
+	},
+}
+
+// slackChannel returns the channel the watch posts to
+func (w LabelWatch) slackChannel() (slack.Channel, error) {
+	if w.Webhook == "" && w.ChannelID == "" {
+		return slack.ChannelByName(w.Channel)
+	}
+	return slack.NewChannel(w.Channel, w.Webhook, w.ChannelID)
+}
+
+// loadLabelWatches returns the watches of the default account from the G_LABEL_WATCHES file at path
+func loadLabelWatches(path string) ([]LabelWatch, error) {
+	if path == "" {
+		return append([]LabelWatch{}, defaultWatches...), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read G_LABEL_WATCHES file: %w", err)
+	}
+
+	var watches []LabelWatch
+	if err := json.Unmarshal(data, &watches); err != nil {
+		return nil, fmt.Errorf("failed to parse G_LABEL_WATCHES file: %w", err)
+	}
+
+	return watches, nil
+}
@@ -0,0 +1,154 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"my-api/admin"
+	"my-api/config"
+	"my-api/gmail"
+	"my-api/jobs"
+	"my-api/slack"
+	hooks "my-api/webhooks"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const checkTimeout = 5 * time.Second
+
+var (
+	cfg       *config.Config
+	jm        *jobs.Manager
+	startedAt time.Time
+)
+
+// InitHealth needs the loaded config and the job manager the app runs with
+func InitHealth(appConfig *config.Config, manager *jobs.Manager) {
+	cfg, jm = appConfig, manager
+	startedAt = time.Now().UTC()
+}
+
+type check struct {
+	name string
+	fn   func(context.Context) error
+}
+
+var checks = []check{
+	{name: "config", fn: checkConfig},
+	{name: "gmail", fn: checkGmail},
+	{name: "slack", fn: func(context.Context) error { return slack.CheckChannels() }},
+	{name: "scheduler", fn: checkScheduler},
+	{name: "storage", fn: func(context.Context) error { return gmail.CheckStorage() }},
+}
+
+func checkConfig(context.Context) error {
+	if cfg == nil {
+		return fmt.Errorf("configuration not loaded")
+	}
+	return nil
+}
+
+func checkGmail(ctx context.Context) error {
+	var errs []error
+	for _, account := range gmail.Accounts() {
+		if err := gmail.CheckToken(ctx, account); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", account.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkScheduler(context.Context) error {
+	if jm == nil || !jm.Scheduling() {
+		return fmt.Errorf("cron scheduler is not running")
+	}
+	return nil
+}
+
+// runChecks returns "ok" or the error of each check, and whether all of them passed
+func runChecks(ctx context.Context) (map[string]string, bool) {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	results := make(map[string]string, len(checks))
+	ready := true
+	for _, check := range checks {
+		results[check.name] = "ok"
+		if err := check.fn(ctx); err != nil {
+			results[check.name] = err.Error()
+			ready = false
+		}
+	}
+	return results, ready
+}
+
+// LiveHandler tells Docker the process is up and serving requests
+func LiveHandler(ctx *gin.Context) {
+	ctx.JSON(200, gin.H{"status": "ok"})
+}
+
+// ReadyHandler reports whether every dependency is usable. Error details are only shown to admins.
+func ReadyHandler(ctx *gin.Context) {
+	results, ready := runChecks(ctx.Request.Context())
+	if !admin.Authorized(ctx) {
+		for name, result := range results {
+			if result != "ok" {
+				results[name] = "failed"
+			}
+		}
+	}
+
+	if !ready {
+		ctx.JSON(503, gin.H{"status": "not_ready", "checks": results})
+		return
+	}
+	ctx.JSON(200, gin.H{"status": "ready", "checks": results})
+}
+
+type accountStatus struct {
+	Email           string            `json:"email"`
+	Auth            string            `json:"auth"`
+	Token           gmail.TokenHealth `json:"token"`
+	WatchExpiration time.Time         `json:"watch_expiration,omitzero"`
+}
+
+// StatusHandler shows the checks together with the last job runs and webhooks, for admins only
+func StatusHandler(ctx *gin.Context) {
+	results, ready := runChecks(ctx.Request.Context())
+
+	accounts := map[string]accountStatus{}
+	for _, account := range gmail.Accounts() {
+		auth := account.Auth
+		if auth == "" {
+			auth = gmail.AuthOAuth
+		}
+		accounts[account.Name] = accountStatus{
+			Email:           account.Email,
+			Auth:            auth,
+			Token:           account.TokenHealth(),
+			WatchExpiration: account.WatchExpiration(),
+		}
+	}
+
+	var running []string
+	var lastRuns map[string]jobs.JobRun
+	if jm != nil {
+		running, lastRuns = jm.Running(), jm.LastRuns()
+	}
+
+	status := 200
+	if !ready {
+		status = 503
+	}
+	ctx.JSON(status, gin.H{
+		"ready":      ready,
+		"mode":       cfg.Mode,
+		"started_at": startedAt,
+		"uptime":     time.Since(startedAt).Round(time.Second).String(),
+		"checks":     results,
+		"gmail":      accounts,
+		"jobs":       gin.H{"running": running, "last_runs": lastRuns},
+		"webhooks":   hooks.LastReceived(),
+	})
+}
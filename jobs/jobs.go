@@ -2,7 +2,10 @@ package jobs
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"my-api/gmail"
+	"time"
 )
 
 type Job interface {
@@ -11,15 +14,100 @@ type Job interface {
 	Run(context.Context) error
 }
 
-type FoodSpotThreadsJob struct{}
+// LabelWatchJob posts new threads of one configured Gmail label watch
+type LabelWatchJob struct {
+	Account *gmail.Account
+	Watch   gmail.LabelWatch
+}
 
-// Runs every 2 hours
-func (j FoodSpotThreadsJob) Name() string { return "FoodSpotThreadsJob" }
+func (j LabelWatchJob) Name() string { return j.Account.Name + "/" + j.Watch.Name }
 
 // included extra 6 fields, leftmost for seconds
-func (j FoodSpotThreadsJob) Schedule() string { return "0 0 */2 * * *" }
+func (j LabelWatchJob) Schedule() string { return j.Watch.Schedule }
+
+func (j LabelWatchJob) Run(ctx context.Context) error {
+	return gmail.SyncLabelWatch(ctx, j.Account, j.Watch)
+}
+
+// LabelWatchJobs creates one job per label watch of every Gmail account
+func LabelWatchJobs() []Job {
+	var jobs []Job
+	for _, account := range gmail.Accounts() {
+		for _, watch := range account.Watches {
+			jobs = append(jobs, LabelWatchJob{Account: account, Watch: watch})
+		}
+	}
+	return jobs
+}
+
+// GmailWatchJob renews the Gmail push watch before it expires. Polling stays on as a fallback.
+type GmailWatchJob struct{}
+
+func (j GmailWatchJob) Name() string { return "GmailWatchJob" }
+
+// Checks every 6 hours
+func (j GmailWatchJob) Schedule() string { return "0 0 */6 * * *" }
+
+// Renews once less than a day is left, Google recommends renewing at least daily
+func (j GmailWatchJob) Run(ctx context.Context) error {
+	if !gmail.PushEnabled() {
+		return nil
+	}
+
+	var errs []error
+	for _, account := range gmail.Accounts() {
+		if time.Until(account.WatchExpiration()) > 24*time.Hour {
+			continue
+		}
+		if err := gmail.Watch(ctx, account); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", account.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// TokenHealthJob refreshes the Gmail token so a revoked consent is reported right away
+type TokenHealthJob struct{}
+
+func (j TokenHealthJob) Name() string { return "TokenHealthJob" }
+
+// Runs every hour at minute 30
+func (j TokenHealthJob) Schedule() string { return "0 30 * * * *" }
+
+func (j TokenHealthJob) Run(ctx context.Context) error {
+	var errs []error
+	for _, account := range gmail.Accounts() {
+		health := gmail.CheckTokenHealth(ctx, account)
+		if health.Status != gmail.TokenOK {
+			errs = append(errs, fmt.Errorf("gmail token of %s is %s: %s", account.Name, health.Status, health.Error))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ClassifyJob labels new inbox mail of one account with the G_CLASSIFIER rules
+type ClassifyJob struct {
+	Account *gmail.Account
+}
+
+func (j ClassifyJob) Name() string { return j.Account.Name + "/ClassifyJob" }
+
+func (j ClassifyJob) Schedule() string { return gmail.ClassifierSchedule() }
+
+func (j ClassifyJob) Run(ctx context.Context) error {
+	return gmail.ClassifyNew(ctx, j.Account)
+}
 
-// Runs every 2 hours
-func (j FoodSpotThreadsJob) Run(ctx context.Context) error {
-	return gmail.GetNewThreadsByLabel(ctx, "Mangopost/FoodSpot Requests")
+// ClassifyJobs creates one job per Gmail account when the classifier is configured
+func ClassifyJobs() []Job {
+	var jobs []Job
+	if !gmail.ClassifierEnabled() {
+		return jobs
+	}
+	for _, account := range gmail.Accounts() {
+		jobs = append(jobs, ClassifyJob{Account: account})
+	}
+	return jobs
 }
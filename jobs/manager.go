@@ -4,6 +4,12 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"my-api/logging"
+	"my-api/metrics"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
@@ -11,15 +17,34 @@ import (
 
 type Manager struct {
 	context context.Context
+	cancel  context.CancelFunc
 	jobs    []Job
 	cron    *cron.Cron
+
+	mu         sync.Mutex
+	running    map[string]int
+	lastRuns   map[string]JobRun
+	wg         sync.WaitGroup
+	scheduling bool
+	stopping   bool
+}
+
+// JobRun is the outcome of a job's last run
+type JobRun struct {
+	StartedAt time.Time `json:"started_at"`
+	Took      string    `json:"took"`
+	Error     string    `json:"error,omitempty"`
 }
 
 func NewJobManager(ctx context.Context) *Manager {
+	ctx, cancel := context.WithCancel(ctx)
 	return &Manager{
-		context: ctx,
-		jobs:    []Job{},
-		cron:    cron.New(cron.WithSeconds(), cron.WithLocation(time.UTC)),
+		context:  ctx,
+		cancel:   cancel,
+		jobs:     []Job{},
+		cron:     cron.New(cron.WithSeconds(), cron.WithLocation(time.UTC)),
+		running:  map[string]int{},
+		lastRuns: map[string]JobRun{},
 	}
 }
 
@@ -27,35 +52,124 @@ func (jm *Manager) AppendJob(job Job) {
 	jm.jobs = append(jm.jobs, job)
 }
 
-func (jm *Manager) Stop() {
-	shutdownCtx := jm.cron.Stop()
+// Stop stops scheduling new runs and waits for the running jobs. Jobs still running when ctx
+// expires are cancelled and returned in the error.
+func (jm *Manager) Stop(ctx context.Context) error {
+	jm.mu.Lock()
+	jm.stopping, jm.scheduling = true, false
+	jm.mu.Unlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	cronDone := jm.cron.Stop()
+	done := make(chan struct{})
+	go func() {
+		<-cronDone.Done()
+		jm.wg.Wait()
+		close(done)
+	}()
 
 	select {
-	case <-shutdownCtx.Done():
-		slog.Info("All scheduled jobs stopped successfully")
+	case <-done:
+		return nil
 	case <-ctx.Done():
-		slog.Warn("Some scheduled jobs may not have completed")
+	}
+
+	running := jm.Running()
+	if len(running) == 0 {
+		return nil
+	}
+
+	jm.cancel()
+	return fmt.Errorf("cancelled unfinished jobs: %s", strings.Join(running, ", "))
+}
+
+// Running returns the names of the jobs that are running right now
+func (jm *Manager) Running() []string {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	names := make([]string, 0, len(jm.running))
+	for name := range jm.running {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Scheduling reports whether the cron scheduler is running
+func (jm *Manager) Scheduling() bool {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	return jm.scheduling
+}
+
+// LastRuns returns the last run of every job that ran since startup, by job name
+func (jm *Manager) LastRuns() map[string]JobRun {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	return maps.Clone(jm.lastRuns)
+}
+
+func (jm *Manager) started(job Job) bool {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	if jm.stopping {
+		return false
+	}
+	jm.running[job.Name()]++
+	jm.wg.Add(1)
+	return true
+}
+
+func (jm *Manager) finished(job Job, start time.Time, err error) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+
+	took := time.Since(start)
+	metrics.JobRun(job.Name(), took, err)
+
+	run := JobRun{StartedAt: start.UTC(), Took: took.Round(time.Millisecond).String()}
+	if err != nil {
+		run.Error = err.Error()
+	}
+	jm.lastRuns[job.Name()] = run
+
+	if jm.running[job.Name()]--; jm.running[job.Name()] == 0 {
+		delete(jm.running, job.Name())
+	}
+	jm.wg.Done()
+}
+
+// RunJob runs a job once outside of its schedule, e.g. at startup. Nothing runs once the manager is stopping.
+// Every run gets its own request ID, so its Gmail and Slack calls can be traced like a request's.
+func (jm *Manager) RunJob(job Job) {
+	if !jm.started(job) {
+		return
+	}
+	start := time.Now()
+	var err error
+	defer func() { jm.finished(job, start, err) }()
+
+	ctx, cancel := context.WithTimeout(jm.context, 1*time.Minute)
+	defer cancel()
+	ctx = logging.With(logging.WithRequestID(ctx, logging.NewRequestID()), slog.String("job", job.Name()))
+
+	defer func() {
+		if r := recover(); r != nil {
+			logging.From(ctx).Error(fmt.Sprintf("Cronjob %q panicked: %s", job.Name(), r))
+			err = fmt.Errorf("panicked: %v", r)
+		}
+	}()
+
+	if err = job.Run(ctx); err != nil {
+		logging.From(ctx).Warn(fmt.Sprintf("Cronjob %q failed: %s", job.Name(), err.Error()))
 	}
 }
 
 func (jm *Manager) ScheduleCronjobs() {
 	for _, job := range jm.jobs {
 		_, err := jm.cron.AddFunc(job.Schedule(), func() {
-			defer func() {
-				if r := recover(); r != nil {
-					slog.Error(fmt.Sprintf("Cronjob %q panicked: %s", job.Name(), r))
-				}
-			}()
-
-			ctx, cancel := context.WithTimeout(jm.context, 1*time.Minute)
-			defer cancel()
-
-			if err := job.Run(ctx); err != nil {
-				slog.Warn(fmt.Sprintf("Cronjob %q failed: %s", job.Name(), err.Error()))
-			}
+			jm.RunJob(job)
 		})
 
 		if err != nil {
@@ -66,4 +180,8 @@ func (jm *Manager) ScheduleCronjobs() {
 	}
 
 	jm.cron.Start()
+
+	jm.mu.Lock()
+	jm.scheduling = !jm.stopping
+	jm.mu.Unlock()
 }
@@ -0,0 +1,107 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// Header carries the request ID in from clients and out to Slack and Gmail
+const Header = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+type contextKey struct{}
+
+type scope struct {
+	id     string
+	logger *slog.Logger
+}
+
+// NewRequestID returns a random ID for work that didn't come in with one, e.g. a job run
+func NewRequestID() string {
+	return uuid.New().String()
+}
+
+// ValidRequestID accepts IDs made of letters, digits and ._:- so they can't break log lines or headers
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == ':', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequestID stores the ID and a logger that adds it to every line
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, scope{id: id, logger: slog.Default().With(slog.String("request_id", id))})
+}
+
+// With adds attributes to the context's logger, keeping the request ID
+func With(ctx context.Context, args ...any) context.Context {
+	current := fromContext(ctx)
+	return context.WithValue(ctx, contextKey{}, scope{id: current.id, logger: current.logger.With(args...)})
+}
+
+// RequestID returns the ID stored in ctx, or "" if there is none
+func RequestID(ctx context.Context) string {
+	return fromContext(ctx).id
+}
+
+// From returns the context's logger, or the default logger if ctx has none
+func From(ctx context.Context) *slog.Logger {
+	return fromContext(ctx).logger
+}
+
+// Carry copies the request ID and logger of from onto ctx, for work that outlives the request,
+// such as async queues that run on their own context
+func Carry(ctx, from context.Context) context.Context {
+	if from == nil {
+		return ctx
+	}
+	current, ok := from.Value(contextKey{}).(scope)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, current)
+}
+
+func fromContext(ctx context.Context) scope {
+	if ctx != nil {
+		if current, ok := ctx.Value(contextKey{}).(scope); ok {
+			return current
+		}
+	}
+	return scope{logger: slog.Default()}
+}
+
+// Transport sets the request ID of the outgoing request's context as X-Request-ID
+type Transport struct {
+	Base http.RoundTripper
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	id := RequestID(req.Context())
+	if id == "" || req.Header.Get(Header) != "" {
+		return base.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set(Header, id)
+	return base.RoundTrip(req)
+}
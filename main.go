@@ -2,70 +2,104 @@ package main
 
 import (
 	"context"
+	"errors"
 	"log/slog"
+	"my-api/admin"
+	"my-api/config"
 	"my-api/gmail"
+	"my-api/health"
+	"my-api/logging"
+	"my-api/metrics"
 	hooks "my-api/webhooks"
+	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"syscall"
-
-	"github.com/joho/godotenv"
 )
 
+// commands run instead of the server when named as the first argument, e.g. ./api migrate-token
+var commands = map[string]func(ctx context.Context, cfg *config.Config, args []string) error{
+	"migrate-token":    runMigrateToken,
+	"sync-watch":       runSyncWatch,
+	"classify-report":  runClassifyReport,
+	"train-classifier": runTrainClassifier,
+}
+
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
-	mode := os.Getenv("GIN_MODE")
-	if mode == "" {
-		mode = "dev"
+	cfg, err := config.Load()
+	if err != nil {
+		slog.Error("Failed to load configuration", slog.Any("error", err))
+		os.Exit(1)
 	}
 
+	mode := cfg.Mode
 	slog.SetDefault(setupLogger(mode))
 
-	if mode == "dev" {
-		if err := godotenv.Load("./.env.mangopost"); err != nil {
-			slog.Error("failed to load .env.mangopost variables:", slog.Any("error", err))
-			os.Exit(1)
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			ctx := logging.WithRequestID(ctx, logging.NewRequestID())
+			if err := command(ctx, cfg, os.Args[2:]); err != nil {
+				slog.Error("Command failed", slog.String("command", os.Args[1]), slog.Any("error", err))
+				os.Exit(1)
+			}
+			return
 		}
 	}
 
-	if err := initAtStartup(); err != nil {
+	if err := initAtStartup(cfg); err != nil {
 		slog.Error("Failed to start application", slog.Any("error", err))
 		os.Exit(1)
 	}
 
-	go startScheduledJobs(ctx)
+	jm := startScheduledJobs()
+	health.InitHealth(cfg, jm)
+	metrics.InitMetrics(cfg.MetricsToken)
 
 	router := setupRouter(mode)
 
 	if mode == "dev" {
 		router.SetTrustedProxies(nil) // No proxies on localhost
 	} else {
-		proxies := os.Getenv("TRUSTED_PROXIES")
-		if proxies == "" {
-			slog.Error("Failed to start application", slog.Any("error", "failed to load TRUSTED_PROXIES .env"))
-			os.Exit(1)
-		}
-
-		proxyList := strings.Split(proxies, ",")
-		if err := router.SetTrustedProxies(proxyList); err != nil {
+		if err := router.SetTrustedProxies(cfg.TrustedProxies); err != nil {
 			slog.Error("Failed to set trusted proxies", slog.Any("error", err))
 			os.Exit(1)
 		}
 	}
 
-	router.GET("/auth", gmail.OAuthHandler)           // FOR MANUAL OAUTH SETUP
-	router.GET("/auth/callback", gmail.OAuthCallback) // FOR MANUAL OAUTH SETUP
+	router.GET("/auth", admin.Required(), gmail.OAuthHandler) // FOR MANUAL OAUTH SETUP
+	router.GET("/auth/callback", gmail.OAuthCallback)         // FOR MANUAL OAUTH SETUP, guarded by the flow's state
 	router.POST("/api/events", hooks.Receiver)
+	router.POST("/gmail/push", gmail.PushHandler)
+	router.GET("/health/gmail", gmail.TokenHealthHandler)
+	router.GET("/healthz", health.LiveHandler)
+	router.GET("/readyz", health.ReadyHandler)
+	router.GET("/status", admin.Required(), health.StatusHandler)
+	router.GET("/metrics", metrics.Handler())
+
+	server := newServer(router)
+	serverErr := make(chan error, 1)
+	go func() {
+		slog.Info("Starting server", slog.String("port", "8080"))
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			serverErr <- err
+		}
+	}()
 
-	slog.Info("Starting server", slog.String("port", "8080"))
-	if err := router.Run(":8080"); err != nil {
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		slog.Info("Received shutdown signal, draining requests and jobs", slog.Duration("timeout", shutdownTimeout))
+	case err := <-serverErr:
 		slog.Error("Failed to start server", slog.Any("error", err))
-		os.Exit(1)
+		exitCode = 1
 	}
+	stop() // a second signal kills the process right away
 
-	<-ctx.Done()
-	slog.Info("Shutdown complete")
+	if err := shutdown(server, jm); err != nil {
+		exitCode = 1
+	}
+	os.Exit(exitCode)
 }
@@ -0,0 +1,158 @@
+package metrics
+
+import (
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "mangopost"
+
+var (
+	webhooks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "webhooks_total",
+		Help:      "Webhook deliveries by source, event and response status.",
+	}, []string{"source", "event", "status"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Handler latency by route, method and response status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	slackSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slack_send_attempts_total",
+		Help:      "Slack send attempts by channel and outcome (ok or error).",
+	}, []string{"channel", "outcome"})
+
+	gmailCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gmail_calls_total",
+		Help:      "Gmail API calls by operation, counting every retry.",
+	}, []string{"operation"})
+
+	gmailErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "gmail_errors_total",
+		Help:      "Failed Gmail API calls by operation and HTTP status (or \"network\").",
+	}, []string{"operation", "code"})
+
+	jobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_runs_total",
+		Help:      "Scheduled job runs by job name.",
+	}, []string{"job"})
+
+	jobFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "job_failures_total",
+		Help:      "Failed scheduled job runs by job name.",
+	}, []string{"job"})
+
+	jobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Scheduled job run time by job name.",
+		Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"job"})
+)
+
+var token string
+
+// InitMetrics sets the METRICS_TOKEN scrapers have to send as bearer token. Only dev mode runs without one.
+func InitMetrics(metricsToken string) {
+	token = metricsToken
+}
+
+// Webhook counts a delivery. Unknown sources and events must be passed as "unknown" to keep the label set small.
+func Webhook(source, event string, status int) {
+	webhooks.WithLabelValues(source, event, strconv.Itoa(status)).Inc()
+}
+
+// SlackSend counts one attempt to deliver to a channel
+func SlackSend(channel string, err error) {
+	slackSends.WithLabelValues(channel, outcome(err)).Inc()
+}
+
+// GmailCall counts one Gmail API request. code is the HTTP status of a failed call, or "network".
+func GmailCall(operation string, code string) {
+	gmailCalls.WithLabelValues(operation).Inc()
+	if code != "" {
+		gmailErrors.WithLabelValues(operation, code).Inc()
+	}
+}
+
+// JobRun records one run of a job
+func JobRun(job string, took time.Duration, err error) {
+	jobRuns.WithLabelValues(job).Inc()
+	jobDuration.WithLabelValues(job).Observe(took.Seconds())
+	failures := jobFailures.WithLabelValues(job) // exported as 0 until the first failure, so rates work
+	if err != nil {
+		failures.Inc()
+	}
+}
+
+// RegisterQueue exposes the current depth of a queue, e.g. a digest buffer, as mangopost_queue_depth{queue="name"}
+func RegisterQueue(name string, depth func() int) {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "queue_depth",
+		Help:        "Items waiting in an in-memory queue.",
+		ConstLabels: prometheus.Labels{"queue": name},
+	}, func() float64 { return float64(depth()) })
+
+	if err := prometheus.Register(gauge); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if !errors.As(err, &registered) {
+			slog.Warn("Failed to register queue metric", slog.String("queue", name), slog.Any("error", err))
+		}
+	}
+}
+
+func outcome(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// Middleware measures the latency of every matched route
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		requestDuration.WithLabelValues(route, ctx.Request.Method, strconv.Itoa(ctx.Writer.Status())).
+			Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() gin.HandlerFunc {
+	handler := promhttp.Handler()
+	return func(ctx *gin.Context) {
+		if token != "" {
+			bearer, _ := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				ctx.JSON(401, gin.H{"error": "Unauthorized"})
+				return
+			}
+		}
+		handler.ServeHTTP(ctx.Writer, ctx.Request)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"my-api/config"
+	"my-api/gmail"
+	"my-api/logging"
+	"my-api/slack"
+	"os"
+)
+
+// runMigrateToken moves a plain token.json into the store selected by TOKEN_STORE.
+// Usage: ./api migrate-token [-account default] [-from gmail/token.json] [-keep]
+func runMigrateToken(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("migrate-token", flag.ContinueOnError)
+	account := flags.String("account", gmail.DefaultAccount, "gmail account to migrate the token for")
+	from := flags.String("from", "gmail/token.json", "plain token file to migrate")
+	keep := flags.Bool("keep", false, "keep the plain token file after migrating")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := slack.InitChannels(cfg.Slack); err != nil {
+		return fmt.Errorf("failed to init slack channels: %w", err)
+	}
+	if err := gmail.InitConfig(cfg.Gmail); err != nil {
+		return fmt.Errorf("failed to init gmail config: %w", err)
+	}
+
+	if err := gmail.MigrateToken(ctx, *account, *from); err != nil {
+		return err
+	}
+	logging.From(ctx).Info("Migrated token to the configured token store", slog.String("account", *account), slog.String("from", *from))
+
+	if !*keep {
+		// a bind-mounted token file can't be removed (EBUSY), the token is migrated anyway
+		if err := os.Remove(*from); err != nil {
+			logging.From(ctx).Warn("Token migrated but failed to remove the plain token file", slog.String("path", *from), slog.Any("error", err))
+		} else {
+			logging.From(ctx).Info("Removed plain token file", slog.String("path", *from))
+		}
+	}
+
+	return nil
+}
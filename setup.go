@@ -2,17 +2,21 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"my-api/admin"
+	"my-api/config"
 	"my-api/gmail"
 	"my-api/jobs"
+	"my-api/logging"
+	"my-api/metrics"
 	"my-api/slack"
 	hooks "my-api/webhooks"
+	"net/http"
 	"os"
 	"time"
 
-	"github.com/google/uuid"
-
 	"github.com/gin-gonic/gin"
 )
 
@@ -33,15 +37,29 @@ func setupLogger(mode string) *slog.Logger {
 
 func setupRouter(mode string) *gin.Engine {
 	router := gin.New()
+	router.ContextWithFallback = true // *gin.Context then carries the request's logger too
 	router.Use(gin.Recovery())
+	router.Use(metrics.Middleware())
 	router.Use(func(ctx *gin.Context) {
+		id := ctx.GetHeader(logging.Header)
+		if !logging.ValidRequestID(id) {
+			id = logging.NewRequestID()
+		}
+		ctx.Header(logging.Header, id)
+		ctx.Request = ctx.Request.WithContext(logging.WithRequestID(ctx.Request.Context(), id))
+
+		if path := ctx.Request.URL.Path; path == "/healthz" || path == "/readyz" {
+			ctx.Next() // probes run every few seconds, don't log them
+			return
+		}
+
+		logger := logging.From(ctx.Request.Context())
 		start := time.Now()
-		slog.Info("Request",
-			slog.String("id", uuid.New().String()),
+		logger.Info("Request",
 			slog.String("route", fmt.Sprintf("%s %s", ctx.Request.Method, ctx.Request.URL.Path)),
 			slog.String("ip", ctx.ClientIP()))
 		ctx.Next()
-		slog.Info("HTTP Response",
+		logger.Info("HTTP Response",
 			slog.Int("status", ctx.Writer.Status()),
 			slog.Any("error", ctx.Err()),
 			slog.Duration("latency", time.Since(start)))
@@ -54,14 +72,15 @@ func setupRouter(mode string) *gin.Engine {
 	return router
 }
 
-func initAtStartup() error {
+func initAtStartup(cfg *config.Config) error {
 	inits := []struct {
 		name string
 		fn   func() error
 	}{
-		{name: "gmail.InitConfig()", fn: gmail.InitConfig},
-		{name: "slack.InitChannels()", fn: slack.InitChannels},
-		{name: "hooks.InitEventHandling()", fn: hooks.InitEventHandling},
+		{name: "admin.InitAdmin()", fn: func() error { return admin.InitAdmin(cfg.Admin) }},
+		{name: "slack.InitChannels()", fn: func() error { return slack.InitChannels(cfg.Slack) }},
+		{name: "gmail.InitConfig()", fn: func() error { return gmail.InitConfig(cfg.Gmail) }},
+		{name: "hooks.InitEventHandling()", fn: func() error { return hooks.InitEventHandling(cfg.Webhooks) }},
 	}
 
 	for _, init := range inits {
@@ -74,14 +93,78 @@ func initAtStartup() error {
 	return nil
 }
 
-func startScheduledJobs(ctx context.Context) {
-	jm := jobs.NewJobManager(ctx)
-	jm.AppendJob((jobs.FoodSpotThreadsJob{}))
+func startScheduledJobs() *jobs.Manager {
+	jm := jobs.NewJobManager(context.Background())
+	for _, job := range jobs.LabelWatchJobs() {
+		jm.AppendJob(job)
+	}
+	for _, job := range jobs.ClassifyJobs() {
+		jm.AppendJob(job)
+	}
+	jm.AppendJob((jobs.GmailWatchJob{}))
+	jm.AppendJob((jobs.TokenHealthJob{}))
 	jm.ScheduleCronjobs()
 
 	go func() {
-		<-ctx.Done()
-		slog.Info("Received shutdown signal, stopping all scheduled jobs")
-		jm.Stop()
+		jm.RunJob(jobs.TokenHealthJob{})
+		jm.RunJob(jobs.GmailWatchJob{})
 	}()
+
+	return jm
+}
+
+func newServer(router *gin.Engine) *http.Server {
+	return &http.Server{
+		Addr:              ":8080",
+		Handler:           router,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      45 * time.Second, // webhook handlers wait for Slack (3 attempts of 10s) and an order confirmation (10s)
+		IdleTimeout:       60 * time.Second,
+	}
+}
+
+const shutdownTimeout = 30 * time.Second
+
+// shutdown stops accepting requests, then drains in-flight handlers, scheduled jobs, push
+// triggered Gmail fetches and Slack digests, all within shutdownTimeout
+func shutdown(server *http.Server, jm *jobs.Manager) error {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	steps := []struct {
+		name string
+		fn   func(context.Context) error
+	}{
+		{name: "http server", fn: func(ctx context.Context) error {
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				return fmt.Errorf("closed connections of unfinished requests: %w", err)
+			}
+			return nil
+		}},
+		{name: "scheduled jobs", fn: jm.Stop},
+		{name: "gmail push fetches", fn: gmail.StopPushSyncs},
+		{name: "slack digests", fn: hooks.StopDigests},
+	}
+
+	start := time.Now()
+	var errs []error
+	for _, step := range steps {
+		stepStart := time.Now()
+		if err := step.fn(ctx); err != nil {
+			slog.Warn("Shutdown step incomplete", slog.String("step", step.name),
+				slog.Duration("took", time.Since(stepStart)), slog.Any("error", err))
+			errs = append(errs, fmt.Errorf("%s: %w", step.name, err))
+			continue
+		}
+		slog.Info("Shutdown step done", slog.String("step", step.name), slog.Duration("took", time.Since(stepStart)))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		slog.Error("Shutdown incomplete", slog.Duration("took", time.Since(start)), slog.Any("error", err))
+		return err
+	}
+	slog.Info("Shutdown complete", slog.Duration("took", time.Since(start)))
+	return nil
 }
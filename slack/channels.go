@@ -4,31 +4,35 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"my-api/config"
+	"my-api/logging"
+	"my-api/metrics"
 	"my-api/utils"
 	"net/http"
-	"os"
+	"net/url"
 	"time"
 )
 
-type Channel struct{ Name, URL string }
+// Channel posts through its incoming webhook URL. With SLACK_BOT_TOKEN and the channel's ID set,
+// Post uses chat.postMessage instead, which returns the message timestamp needed for threads.
+type Channel struct{ Name, URL, ID string }
 
 var (
 	client                               *http.Client
+	botToken                             string
 	Internal, OrderHistory, ScriptErrors Channel
 )
 
-func InitChannels() error {
-	client = &http.Client{Timeout: 10 * time.Second}
+func InitChannels(cfg config.Slack) error {
+	client = &http.Client{Timeout: 10 * time.Second, Transport: &logging.Transport{}}
+	botToken = cfg.BotToken
 
-	Internal = Channel{Name: "internal-notifications", URL: os.Getenv("SLACK_INTERNAL_NOTIFICATIONS")}
-	OrderHistory = Channel{Name: "order-history", URL: os.Getenv("SLACK_ORDER_HISTORY")}
-	ScriptErrors = Channel{Name: "script-errors", URL: os.Getenv("SLACK_SCRIPT_ERRORS")}
-
-	if Internal.URL == "" || OrderHistory.URL == "" || ScriptErrors.URL == "" {
-		return fmt.Errorf("failed to initialize Slack channels. Invalid .env variables")
-	}
+	Internal = Channel{Name: "internal-notifications", URL: cfg.InternalNotifications, ID: cfg.InternalNotificationsID}
+	OrderHistory = Channel{Name: "order-history", URL: cfg.OrderHistory, ID: cfg.OrderHistoryID}
+	ScriptErrors = Channel{Name: "script-errors", URL: cfg.ScriptErrors, ID: cfg.ScriptErrorsID}
 
 	return nil
 }
@@ -65,34 +69,153 @@ func (c Channel) Send(ctx context.Context, payload Payload) error {
 		req.Header.Set("Content-Type", "application/json")
 		res, err := client.Do(req)
 		if err != nil {
-			if attempt < 2 {
-				time.Sleep(1 * time.Second)
+			metrics.SlackSend(c.Name, err)
+			if attempt < 2 && waitRetry(ctx) == nil {
 				continue
-			} else {
-				return &utils.APIError{
-					Err:    fmt.Errorf("failed to send Slack request after %d attempts: %w", attempt+1, err),
-					Status: 504,
-				}
+			}
+			return &utils.APIError{
+				Err:    fmt.Errorf("failed to send Slack request after %d attempts: %w", attempt+1, err),
+				Status: 504,
 			}
 		}
 
 		defer res.Body.Close()
 
 		if res.StatusCode == 200 {
+			metrics.SlackSend(c.Name, nil)
 			break
 		}
+		metrics.SlackSend(c.Name, fmt.Errorf("status %d", res.StatusCode))
 
-		if attempt < 2 {
-			time.Sleep(1 * time.Second)
+		if attempt < 2 && waitRetry(ctx) == nil {
 			continue
-		} else {
-			return &utils.APIError{
-				Err:    fmt.Errorf("slack returned non-200 status: %d", res.StatusCode),
-				Status: res.StatusCode,
-			}
+		}
+		return &utils.APIError{
+			Err:    fmt.Errorf("slack returned non-200 status: %d", res.StatusCode),
+			Status: res.StatusCode,
 		}
 	}
 
-	slog.Debug("Successfully sent message to Slack")
+	logging.From(ctx).Debug("Successfully sent message to Slack", slog.String("channel", c.Name))
 	return nil
 }
+
+// waitRetry pauses before the next attempt, unless the caller's deadline (e.g. the webhook's) ends first
+func waitRetry(ctx context.Context) error {
+	select {
+	case <-time.After(1 * time.Second):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SupportsThreads reports whether Post returns timestamps that replies can be threaded under
+func (c Channel) SupportsThreads() bool {
+	return botToken != "" && c.ID != ""
+}
+
+const postMessageURL = "https://slack.com/api/chat.postMessage"
+
+// Post sends the payload and returns its message timestamp. Without thread support it falls
+// back to the webhook, returns an empty timestamp and ignores payload.ThreadTS.
+func (c Channel) Post(ctx context.Context, payload Payload) (string, error) {
+	if !c.SupportsThreads() {
+		payload.ThreadTS = ""
+		return "", c.Send(ctx, payload)
+	}
+
+	body, err := json.Marshal(struct {
+		Channel string `json:"channel"`
+		Payload
+	}{Channel: c.ID, Payload: payload})
+	if err != nil {
+		return "", &utils.APIError{Err: fmt.Errorf("failed to marshal json: %w", err), Status: 500}
+	}
+
+	var lastErr error
+	for attempt := 0; attempt <= 2; attempt++ {
+		if attempt > 0 && waitRetry(ctx) != nil {
+			break
+		}
+
+		ts, err := c.postMessage(ctx, body)
+		metrics.SlackSend(c.Name, err)
+		if err == nil {
+			logging.From(ctx).Debug("Successfully posted message to Slack", slog.String("channel", c.Name))
+			return ts, nil
+		}
+		lastErr = err
+	}
+
+	return "", &utils.APIError{
+		Err:    fmt.Errorf("failed to post Slack message after 3 attempts: %w", lastErr),
+		Status: 504,
+	}
+}
+
+func (c Channel) postMessage(ctx context.Context, body []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", postMessageURL, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+botToken)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var result struct {
+		OK    bool   `json:"ok"`
+		TS    string `json:"ts"`
+		Error string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("slack returned status %d with an unreadable body: %w", res.StatusCode, err)
+	}
+	if !result.OK {
+		return "", fmt.Errorf("slack chat.postMessage to %s failed: %s", c.Name, result.Error)
+	}
+
+	return result.TS, nil
+}
+
+// CheckChannels returns an error unless every channel has a webhook URL
+func CheckChannels() error {
+	var errs []error
+	for _, channel := range []Channel{Internal, OrderHistory, ScriptErrors} {
+		if channel.URL == "" {
+			errs = append(errs, fmt.Errorf("slack channel %s has no webhook URL", channel.Name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// ChannelByName looks up one of the configured channels, e.g. for channels chosen in config files
+func ChannelByName(name string) (Channel, error) {
+	for _, channel := range []Channel{Internal, OrderHistory, ScriptErrors} {
+		if channel.Name == name {
+			return channel, nil
+		}
+	}
+
+	return Channel{}, fmt.Errorf("unknown slack channel %q", name)
+}
+
+// NewChannel builds a channel besides the configured ones, e.g. for a single label watch.
+// It needs a webhook URL, or the channel ID together with SLACK_BOT_TOKEN.
+func NewChannel(name, webhookURL, id string) (Channel, error) {
+	if webhookURL != "" {
+		parsed, err := url.Parse(webhookURL)
+		if err != nil || (parsed.Scheme != "https" && parsed.Scheme != "http") || parsed.Host == "" {
+			return Channel{}, fmt.Errorf("slack channel %q: invalid webhook URL", name)
+		}
+	} else if id == "" || botToken == "" {
+		return Channel{}, fmt.Errorf("slack channel %q needs a webhook URL, or a channel ID and SLACK_BOT_TOKEN", name)
+	}
+
+	return Channel{Name: name, URL: webhookURL, ID: id}, nil
+}
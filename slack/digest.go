@@ -0,0 +1,161 @@
+package slack
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"my-api/logging"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Digest buffers payloads for a channel and sends them as a single summary
+// message once Window has passed since the first buffered event or MaxItems is reached.
+type Digest struct {
+	Channel  Channel
+	Title    string
+	Window   time.Duration
+	MaxItems int
+
+	mu         sync.Mutex
+	pending    []Payload
+	requestIDs []string // of the buffered events, logged with the digest to trace them
+	started    time.Time
+	timer      *time.Timer
+	sending    sync.WaitGroup
+	stopped    bool
+}
+
+func NewDigest(channel Channel, title string, window time.Duration, maxItems int) *Digest {
+	return &Digest{
+		Channel:  channel,
+		Title:    title,
+		Window:   window,
+		MaxItems: maxItems,
+	}
+}
+
+// Add buffers a payload. Once the digest is stopped payloads are sent right away.
+func (d *Digest) Add(ctx context.Context, payload Payload) error {
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		return d.Channel.Send(ctx, payload)
+	}
+
+	if len(d.pending) == 0 {
+		d.started = time.Now()
+		d.timer = time.AfterFunc(d.Window, d.flush)
+	}
+	d.pending = append(d.pending, payload)
+	if id := logging.RequestID(ctx); id != "" {
+		d.requestIDs = append(d.requestIDs, id)
+	}
+	full := d.MaxItems > 0 && len(d.pending) >= d.MaxItems
+	d.mu.Unlock()
+
+	if full {
+		d.flush()
+	}
+	return nil
+}
+
+// Len returns the number of buffered payloads
+func (d *Digest) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.pending)
+}
+
+// Stop sends whatever is still buffered and waits for in-flight digests to be delivered until ctx expires.
+func (d *Digest) Stop(ctx context.Context) error {
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+
+	d.flushWithin(ctx)
+
+	done := make(chan struct{})
+	go func() {
+		d.sending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("digest %q may not have been delivered", d.Title)
+	}
+}
+
+func (d *Digest) flush() {
+	d.flushWithin(context.Background())
+}
+
+// flushWithin sends the buffered payloads in the background, giving up when parent is done
+func (d *Digest) flushWithin(parent context.Context) {
+	d.mu.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	batch, requestIDs := d.pending, d.requestIDs
+	started := d.started
+	d.pending, d.requestIDs = nil, nil
+	if len(batch) > 0 {
+		d.sending.Add(1)
+	}
+	d.mu.Unlock()
+
+	if len(batch) == 0 {
+		return
+	}
+
+	go func() {
+		defer d.sending.Done()
+
+		ctx, cancel := context.WithTimeout(parent, 30*time.Second)
+		defer cancel()
+		ctx = logging.WithRequestID(ctx, logging.NewRequestID())
+		logger := logging.From(ctx).With(slog.Any("event_request_ids", requestIDs))
+
+		if err := d.Channel.Send(ctx, d.summary(batch, started)); err != nil {
+			logger.Error(fmt.Sprintf("Failed to send %q digest with %d events", d.Title, len(batch)), slog.Any("error", err))
+			return
+		}
+		logger.Info(fmt.Sprintf("Sent %q digest with %d events", d.Title, len(batch)))
+	}()
+}
+
+// summary builds one message out of the buffered payloads, keeping each event as its own attachment
+func (d *Digest) summary(batch []Payload, started time.Time) Payload {
+	minutes := int(time.Since(started).Round(time.Minute).Minutes())
+	if minutes < 1 {
+		minutes = 1
+	}
+
+	summary := NewMessage(fmt.Sprintf("*%s* (%d in the last %d min)", d.Title, len(batch), minutes))
+	for _, payload := range batch {
+		var sb strings.Builder
+		sb.WriteString(payload.Text)
+
+		color, footer := "", ""
+		var fields []Field
+		for _, attachment := range payload.Attachments {
+			sb.WriteString("\n" + attachment.Text)
+			if color == "" {
+				color = attachment.Color
+			}
+			if footer == "" {
+				footer = attachment.Footer
+			}
+			fields = append(fields, attachment.Fields...)
+		}
+
+		summary.Attach([]Attachment{{Text: sb.String(), Color: color, Footer: footer, Fields: fields}})
+	}
+
+	return *summary
+}
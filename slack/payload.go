@@ -3,12 +3,20 @@ package slack
 type Payload struct {
 	Text        string       `json:"text"`
 	Attachments []Attachment `json:"attachments,omitempty"`
+	ThreadTS    string       `json:"thread_ts,omitempty"` // only used by Channel.Post
 }
 
 type Attachment struct {
-	Text   string `json:"text"`
-	Color  string `json:"color"`
-	Footer string `json:"footer,omitempty"`
+	Text   string  `json:"text"`
+	Color  string  `json:"color"`
+	Footer string  `json:"footer,omitempty"`
+	Fields []Field `json:"fields,omitempty"`
+}
+
+type Field struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
+	Short bool   `json:"short,omitempty"`
 }
 
 func (p *Payload) Attach(attachments []Attachment) *Payload {
@@ -0,0 +1,134 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrNotFound = errors.New("state not found")
+
+// CorruptError means a stored value exists but can't be decoded. Callers must not
+// treat it like a missing value, otherwise sync positions get silently reset.
+type CorruptError struct {
+	Key, Path string
+	Err       error
+}
+
+func (e *CorruptError) Error() string {
+	return fmt.Sprintf("state %q in %s is corrupted: %v", e.Key, e.Path, e.Err)
+}
+
+func (e *CorruptError) Unwrap() error { return e.Err }
+
+// Store keeps small JSON documents such as sync cursors by key
+type Store interface {
+	// Get decodes the value stored under key into target, returning ErrNotFound if there is none
+	Get(key string, target any) error
+	Put(key string, value any) error
+	// Check returns an error if values can't be written right now, e.g. a full or read-only disk
+	Check() error
+}
+
+// FileStore stores each key as a JSON file in a directory. Writes go to a temp file that is
+// synced and renamed over the old one, so a crash never leaves a half-written file behind.
+type FileStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory %s: %w", dir, err)
+	}
+
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(key string) string {
+	return filepath.Join(s.dir, url.PathEscape(key)+".json")
+}
+
+func (s *FileStore) Get(key string, target any) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := s.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
+		return fmt.Errorf("failed to read state file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, target); err != nil {
+		return &CorruptError{Key: key, Path: path, Err: err}
+	}
+
+	return nil
+}
+
+func (s *FileStore) Put(key string, value any) error {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal state %q: %w", key, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return WriteFileAtomic(s.path(key), data, 0600)
+}
+
+func (s *FileStore) Check() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(s.dir, ".healthcheck")
+	if err := WriteFileAtomic(path, []byte("ok"), 0600); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// WriteFileAtomic writes data to a temp file in the same directory and renames it over path
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name()) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to set permissions on %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	// persist the rename itself
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log/slog"
+	"my-api/config"
+	"my-api/gmail"
+	"my-api/logging"
+	"time"
+)
+
+// runSyncWatch runs one label watch once, e.g. against a fake mailbox (G_AUTH_MODE=fake, G_FAKE_SEED=seed.json).
+// Usage: ./api sync-watch [-account default] -watch FoodSpotThreadsJob [-since 24h]
+func runSyncWatch(ctx context.Context, cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("sync-watch", flag.ContinueOnError)
+	accountName := flags.String("account", "", "gmail account, optional when only one is configured")
+	watchName := flags.String("watch", "", "label watch to run")
+	since := flags.Duration("since", 0, "report every thread of the last duration instead of continuing from the cursor")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	account, err := initGmailCommand(cfg, *accountName)
+	if err != nil {
+		return err
+	}
+	watch, err := account.WatchByName(*watchName)
+	if err != nil {
+		return err
+	}
+
+	if *since > 0 {
+		if err := gmail.Rewind(account, watch.Name, time.Now().Add(-*since)); err != nil {
+			return err
+		}
+	}
+
+	if err := gmail.SyncLabelWatch(ctx, account, watch); err != nil {
+		return err
+	}
+	logging.From(ctx).Info("Synced label watch", slog.String("account", account.Name), slog.String("watch", watch.Name))
+	return nil
+}
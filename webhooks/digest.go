@@ -0,0 +1,56 @@
+package hooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"my-api/config"
+	"my-api/metrics"
+	"my-api/slack"
+	"sync"
+)
+
+// initDigests switches the routes parsed from SLACK_DIGEST_ROUTES to digest mode
+func initDigests(digests []config.DigestRoute) error {
+	for _, digest := range digests {
+		route, ok := eventHandlers[digest.From][digest.Event]
+		if !ok {
+			return fmt.Errorf("invalid SLACK_DIGEST_ROUTES entry: unknown route \"%s:%s\"", digest.From, digest.Event)
+		}
+
+		route.digest = slack.NewDigest(route.channel, route.title, digest.Window, digest.MaxItems)
+		metrics.RegisterQueue(fmt.Sprintf("digest:%s:%s", digest.From, digest.Event), route.digest.Len)
+		slog.Debug(fmt.Sprintf("Route \"%s:%s\" is in digest mode (window %s, max %d items)",
+			digest.From, digest.Event, digest.Window, digest.MaxItems))
+	}
+
+	return nil
+}
+
+// StopDigests flushes every buffered digest, waiting for delivery until ctx expires
+func StopDigests(ctx context.Context) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+	for _, routes := range eventHandlers {
+		for _, route := range routes {
+			if route.digest == nil {
+				continue
+			}
+
+			wg.Add(1)
+			go func(d *slack.Digest) {
+				defer wg.Done()
+				if err := d.Stop(ctx); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}(route.digest)
+		}
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
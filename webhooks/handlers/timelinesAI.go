@@ -5,8 +5,6 @@ import (
 	"fmt"
 	"my-api/slack"
 	"my-api/utils"
-
-	"github.com/gin-gonic/gin"
 )
 
 type newMessage struct {
@@ -21,10 +19,10 @@ type newMessage struct {
 	} `json:"message"`
 }
 
-func NewTimelinesMessage(ctx *gin.Context, rawData json.RawMessage) error {
+func FormatTimelinesMessage(rawData json.RawMessage) (*slack.Payload, error) {
 	var data newMessage
 	if err := utils.UnmarshalOrErr(rawData, &data); err != nil {
-		return err
+		return nil, err
 	}
 
 	phone := data.Chat.Phone
@@ -41,19 +39,17 @@ func NewTimelinesMessage(ctx *gin.Context, rawData json.RawMessage) error {
 		},
 	})
 
-	return slack.Internal.Send(ctx.Request.Context(), *payload)
+	return payload, nil
 }
 
-func AccountConnected(ctx *gin.Context, _ json.RawMessage) error {
+func FormatAccountConnected(_ json.RawMessage) (*slack.Payload, error) {
 	chatUrl := "https://app.timelines.ai/whatsapp"
 	slackText := fmt.Sprintf("*WA account is connected again!*\n<%s|Manage in TimelinesAI>", chatUrl)
-	payload := slack.NewMessage(slackText)
-	return slack.Internal.Send(ctx.Request.Context(), *payload)
+	return slack.NewMessage(slackText), nil
 }
 
-func AccountDisconnected(ctx *gin.Context, _ json.RawMessage) error {
+func FormatAccountDisconnected(_ json.RawMessage) (*slack.Payload, error) {
 	chatUrl := "https://app.timelines.ai/whatsapp"
 	slackText := fmt.Sprintf("*WA account was disconnected!*\n<%s|Manage in TimelinesAI>", chatUrl)
-	payload := slack.NewMessage(slackText)
-	return slack.Internal.Send(ctx.Request.Context(), *payload)
+	return slack.NewMessage(slackText), nil
 }
@@ -1,21 +1,75 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"my-api/config"
+	"my-api/gmail"
 	"my-api/slack"
 	"my-api/utils"
-	"os"
+	"net/mail"
 	"strconv"
 	"strings"
-
-	"github.com/gin-gonic/gin"
+	"time"
 )
 
-func HandleNewUser(ctx *gin.Context, rawData json.RawMessage) error {
+// orderURL is WC_ORDER_URL, the admin order page the order ID is appended to
+var orderURL string
+
+// confirmFrom is the account of WC_ORDER_CONFIRMATION_FROM, nil if confirmations are off
+var confirmFrom *gmail.Account
+
+// sending isn't retried, so a stuck send can't hold the webhook past the server's WriteTimeout
+const confirmTimeout = 10 * time.Second
+
+func InitWooCommerce(cfg config.Webhooks) error {
+	orderURL = cfg.WCOrderURL
+
+	confirmFrom = nil
+	if cfg.OrderConfirmationFrom == "" {
+		return nil
+	}
+	account, err := gmail.CheckOrderConfirmation(cfg.OrderConfirmationFrom)
+	if err != nil {
+		return fmt.Errorf("WC_ORDER_CONFIRMATION_FROM: %w", err)
+	}
+	confirmFrom = account
+	return nil
+}
+
+// ConfirmOrder emails the customer of a new order when WC_ORDER_CONFIRMATION_FROM is set
+func ConfirmOrder(ctx context.Context, rawData json.RawMessage) error {
+	if confirmFrom == nil {
+		return nil
+	}
+
+	var order NewOrder
+	if err := utils.UnmarshalOrErr(rawData, &order); err != nil {
+		return err
+	}
+	if order.Billing.Email == "" {
+		return fmt.Errorf("order %d has no billing email", order.ID)
+	}
+
+	to := mail.Address{
+		Name:    strings.TrimSpace(order.Billing.FirstName + " " + order.Billing.LastName),
+		Address: order.Billing.Email,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, confirmTimeout)
+	defer cancel()
+	return gmail.SendOrderConfirmation(ctx, confirmFrom, to.String(), gmail.OrderConfirmation{
+		Name:    order.Billing.FirstName,
+		OrderID: strconv.Itoa(order.ID),
+		Total:   order.Total,
+	})
+}
+
+func FormatNewUser(rawData json.RawMessage) (*slack.Payload, error) {
 	var user NewUser
 	if err := utils.UnmarshalOrErr(rawData, &user); err != nil {
-		return err
+		return nil, err
 	}
 
 	payload := slack.NewMessage(
@@ -23,24 +77,23 @@ func HandleNewUser(ctx *gin.Context, rawData json.RawMessage) error {
 			user.Username, user.FirstName, user.LastName, user.Email),
 	)
 
-	return slack.Internal.Send(ctx.Request.Context(), *payload)
+	return payload, nil
 }
 
-func HandleNewOrder(ctx *gin.Context, rawData json.RawMessage) error {
+func FormatNewOrder(rawData json.RawMessage) (*slack.Payload, error) {
 	var order NewOrder
 	if err := utils.UnmarshalOrErr(rawData, &order); err != nil {
-		return err
+		return nil, err
 	}
 
 	orderID := strconv.Itoa(order.ID)
-	orderURL := os.Getenv("WC_ORDER_URL")
 	slackURLFormat := fmt.Sprintf("<%s&id=%s|View in Wordpress>", orderURL, orderID)
 
 	var sb strings.Builder
 	sb.WriteString(fmt.Sprintf("*New Order #\u200B%s*\n\n", orderID))
 	order.slackFormatPayment(&sb)
 	if err := order.slackFormatDeliveryDate(&sb); err != nil {
-		return err
+		return nil, err
 	}
 	order.slackFormatCustomer(&sb)
 	order.slackFormatVendor(&sb)
@@ -54,7 +107,7 @@ func HandleNewOrder(ctx *gin.Context, rawData json.RawMessage) error {
 			},
 		})
 
-	return slack.OrderHistory.Send(ctx.Request.Context(), *payload)
+	return payload, nil
 }
 
 func (o *NewOrder) slackFormatPayment(sb *strings.Builder) {
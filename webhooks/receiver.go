@@ -2,59 +2,127 @@ package hooks
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"my-api/config"
+	"my-api/logging"
+	"my-api/metrics"
+	"my-api/slack"
 	"my-api/utils"
 	"my-api/webhooks/handlers"
-	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 )
 
-type eventHandler map[string]func(*gin.Context, json.RawMessage) error
+// route formats a single event and delivers it to its Slack channel, either right away or through a digest
+type route struct {
+	format  func(json.RawMessage) (*slack.Payload, error)
+	channel slack.Channel
+	title   string // heading used when the route is in digest mode
+	digest  *slack.Digest
+
+	// after runs once the event is delivered, e.g. to email the customer. It only logs failures,
+	// a retried webhook would post to Slack twice.
+	after func(context.Context, json.RawMessage) error
+}
+
+func (r *route) handle(ctx *gin.Context, rawData json.RawMessage) error {
+	payload, err := r.format(rawData)
+	if err != nil {
+		return err
+	}
+
+	if r.digest != nil {
+		return r.digest.Add(ctx.Request.Context(), *payload)
+	}
+	return r.channel.Send(ctx.Request.Context(), *payload)
+}
+
+type eventRoutes map[string]*route
 
 var (
-	eventHandlers map[string]eventHandler
+	eventHandlers map[string]eventRoutes
 	wcSecret      string
+
+	receiptsMu sync.Mutex
+	receipts   = map[string]Receipt{}
 )
 
-func InitEventHandling() error {
-	wcSecret = os.Getenv("WC_SECRET")
-	if wcSecret == "" {
-		slog.Error("failed to initialize wcSecret .env variable")
-		return fmt.Errorf("failed to initialize wcSecret .env variable")
+// Receipt is the last webhook received from a source
+type Receipt struct {
+	Event      string    `json:"event"`
+	Status     int       `json:"status"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// LastReceived returns the last webhook of each source since startup
+func LastReceived() map[string]Receipt {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	return maps.Clone(receipts)
+}
+
+func recordReceipt(from, event string, status int, receivedAt time.Time) {
+	receiptsMu.Lock()
+	defer receiptsMu.Unlock()
+	receipts[from] = Receipt{Event: event, Status: status, ReceivedAt: receivedAt.UTC()}
+}
+
+func InitEventHandling(cfg config.Webhooks) error {
+	wcSecret = cfg.WCSecret
+	if err := handlers.InitWooCommerce(cfg); err != nil {
+		return err
 	}
 
-	eventHandlers = map[string]eventHandler{
+	eventHandlers = map[string]eventRoutes{
 		"wc": {
-			"order_created": handlers.HandleNewOrder,
-			"user_created":  handlers.HandleNewUser,
+			"order_created": {format: handlers.FormatNewOrder, channel: slack.OrderHistory, title: "New orders", after: handlers.ConfirmOrder},
+			"user_created":  {format: handlers.FormatNewUser, channel: slack.Internal, title: "New users"},
 		},
 		"timelines": {
-			"new_message":          handlers.NewTimelinesMessage, // actual event - "message:received:new"
-			"account_connected":    handlers.AccountConnected,    // actual event - "whatsapp:account:connected"
-			"account_disconnected": handlers.AccountDisconnected, // actual event - "whatsapp:account:disconnected"
+			"new_message":          {format: handlers.FormatTimelinesMessage, channel: slack.Internal, title: "New WhatsApp messages"},      // actual event - "message:received:new"
+			"account_connected":    {format: handlers.FormatAccountConnected, channel: slack.Internal, title: "WA account connected"},       // actual event - "whatsapp:account:connected"
+			"account_disconnected": {format: handlers.FormatAccountDisconnected, channel: slack.Internal, title: "WA account disconnected"}, // actual event - "whatsapp:account:disconnected"
 		},
 	}
-	return nil
+
+	return initDigests(cfg.Digests)
 }
 
-func logReceiver(source, from, event string) *slog.Logger {
-	return slog.With("source", source, "from", from, "event", event)
+// logReceiver tags the request's logger with the webhook, so Slack sends log them too
+func logReceiver(ctx *gin.Context, source, from, event string) *slog.Logger {
+	ctx.Request = ctx.Request.WithContext(logging.With(ctx.Request.Context(), "from", from, "event", event))
+	return logging.From(ctx.Request.Context()).With("source", source)
 }
 
 func Receiver(ctx *gin.Context) {
 	from := ctx.Query("from")
 	event := ctx.Query("event")
-	logger := logReceiver("hooks.Receiver()", from, event)
+	logger := logReceiver(ctx, "hooks.Receiver()", from, event)
 
 	logger.Debug("Webhook received")
 
-	handler, ok := eventHandlers[from][event]
+	receivedAt := time.Now()
+	defer func() {
+		source, name := "unknown", "unknown"
+		if routes, ok := eventHandlers[from]; ok {
+			source = from
+			if _, ok := routes[event]; ok {
+				name = event
+			}
+			recordReceipt(from, event, ctx.Writer.Status(), receivedAt)
+		}
+		metrics.Webhook(source, name, ctx.Writer.Status())
+	}()
+
+	route, ok := eventHandlers[from][event]
 	if !ok {
 		logger.Warn("Invalid query params")
 		ctx.JSON(400, gin.H{"error": "Invalid query parameters values received"})
@@ -93,7 +161,7 @@ func Receiver(ctx *gin.Context) {
 		}
 	}
 
-	if err := handler(ctx, rawData); err != nil {
+	if err := route.handle(ctx, rawData); err != nil {
 		logger.Error("Failed to process webhook data", slog.Any("error", err))
 
 		var apiErr *utils.APIError
@@ -105,6 +173,12 @@ func Receiver(ctx *gin.Context) {
 		return
 	}
 
+	if route.after != nil {
+		if err := route.after(ctx.Request.Context(), rawData); err != nil {
+			logger.Error("Failed to follow up on webhook", slog.Any("error", err))
+		}
+	}
+
 	logger.Info("Successfully handled webhook data")
 	ctx.JSON(200, gin.H{"message": "Successfully handled webhook data"})
 }